@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"cse224/proj4/pkg/surfstore"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Usage strings
+const USAGE_STRING = "./run-acl.sh -t token host:port grant|revoke path principal [read|write|admin]"
+
+const TOKEN_USAGE = "Token the server knows your user by (default $SURFSTORE_TOKEN)"
+
+// Exit codes
+const EX_USAGE int = 64
+const EX_NOPERM int = 77
+
+func main() {
+	// Custom flag Usage message
+	flag.Usage = func() {
+		w := flag.CommandLine.Output()
+		fmt.Fprintf(w, "Usage of %s:\n", USAGE_STRING)
+		fmt.Fprintf(w, "  -t: %v\n", TOKEN_USAGE)
+		fmt.Fprintf(w, "  principal: user name, or %s for everyone\n", surfstore.ANYONE_PRINCIPAL)
+		fmt.Fprintf(w, "  path: a file, or a directory to share its whole subtree\n")
+	}
+
+	token := flag.String("t", os.Getenv("SURFSTORE_TOKEN"), TOKEN_USAGE)
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) < 4 {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+	hostPort, action, path, principal := args[0], args[1], args[2], args[3]
+
+	rpcClient := surfstore.NewSurfstoreRPCClient(hostPort, "", 0)
+	rpcClient.Token = *token
+
+	var err error
+	switch {
+	case action == "grant" && len(args) == 5:
+		permission, ok := surfstore.ParsePermission(args[4])
+		if !ok || permission == surfstore.Permission_NONE {
+			flag.Usage()
+			os.Exit(EX_USAGE)
+		}
+		err = rpcClient.GrantAccess(context.Background(), path, principal, permission)
+	case action == "revoke" && len(args) == 4:
+		err = rpcClient.RevokeAccess(context.Background(), path, principal)
+	default:
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EX_NOPERM)
+	}
+}
@@ -1,24 +1,76 @@
 package main
 
 import (
+	"context"
 	"cse224/proj4/pkg/surfstore"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // Arguments
 const ARG_COUNT int = 3
 
 // Usage strings
-const USAGE_STRING = "./run-client.sh -d host:port baseDir blockSize"
+const USAGE_STRING = "./run-client.sh -d -t token -daemon -debounce d -dry-run -exclude pattern -select prefix -full-rescan -retries n -timeout d -upload-limit rate -download-limit rate -progress -block-tree n -output table|json host:port baseDir blockSize"
 
 const DEBUG_NAME = "d"
 const DEBUG_USAGE = "Output log statements"
 
+const TOKEN_NAME = "t"
+const TOKEN_USAGE = "Token the server knows your user by (default $SURFSTORE_TOKEN)"
+
+const DAEMON_NAME = "daemon"
+const DAEMON_USAGE = "Keep running and sync local and remote changes as they happen"
+
+const DEBOUNCE_NAME = "debounce"
+const DEBOUNCE_USAGE = "How long local edits have to settle before a daemon sync"
+
+const DRYRUN_NAME = "dry-run"
+const DRYRUN_USAGE = "Only print what a sync would do, without changing anything"
+
+const EXCLUDE_NAME = "exclude"
+const EXCLUDE_USAGE = "Ignore pattern in .surfignore syntax for this run, may be repeated"
+
+const SELECT_NAME = "select"
+const SELECT_USAGE = "Only sync files under this path prefix from now on, may be repeated; / selects everything again"
+
+const FULLRESCAN_NAME = "full-rescan"
+const FULLRESCAN_USAGE = "Hash every file, even those whose size and modification time are unchanged"
+
+const RETRIES_NAME = "retries"
+const RETRIES_USAGE = "How many times a call to the server is attempted before the sync gives up on it"
+
+const TIMEOUT_NAME = "timeout"
+const TIMEOUT_USAGE = "How long an attempt may take before it is retried, plus time for its payload at 64 KiB/s; 0 disables it"
+
+const UPLOADLIMIT_NAME = "upload-limit"
+const UPLOADLIMIT_USAGE = "Upload bandwidth in bytes/s (K, M, G suffixes), optionally per time of day: 10M,09:00-18:00=1M"
+
+const DOWNLOADLIMIT_NAME = "download-limit"
+const DOWNLOADLIMIT_USAGE = "Download bandwidth, in the same format as -upload-limit"
+
+const PROGRESS_NAME = "progress"
+const PROGRESS_USAGE = "Draw a progress bar on stderr (default when stderr is a terminal)"
+
+const BLOCKTREE_NAME = "block-tree"
+const BLOCKTREE_USAGE = "Store the block list of files with more than n blocks as a tree of index blocks in the BlockStore, 0 never"
+
+const OUTPUT_NAME = "output"
+const OUTPUT_USAGE = "Format of the sync report: table or json"
+
 const ADDR_NAME = "host:port"
 const ADDR_USAGE = "IP address and port of the MetaStore the client is syncing to"
 
@@ -26,10 +78,16 @@ const BASEDIR_NAME = "baseDir"
 const BASEDIR_USAGE = "Base directory of the client"
 
 const BLOCK_NAME = "blockSize"
-const BLOCK_USAGE = "Size of the blocks used to fragment files"
+const BLOCK_USAGE = "Size of the blocks used to fragment new files, 0 uses the MetaStore's default"
 
 // Exit codes
 const EX_USAGE int = 64
+const EX_UNAVAILABLE int = 69
+const EX_SOFTWARE int = 70
+const EX_IOERR int = 74
+const EX_TEMPFAIL int = 75
+const EX_NOPERM int = 77
+const EX_INTERRUPTED int = 130
 
 func main() {
 	// Custom flag Usage message
@@ -37,6 +95,20 @@ func main() {
 		w := flag.CommandLine.Output()
 		fmt.Fprintf(w, "Usage of %s:\n", USAGE_STRING)
 		fmt.Fprintf(w, "  -%s: %v\n", DEBUG_NAME, DEBUG_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TOKEN_NAME, TOKEN_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", DAEMON_NAME, DAEMON_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", DEBOUNCE_NAME, DEBOUNCE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", DRYRUN_NAME, DRYRUN_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", EXCLUDE_NAME, EXCLUDE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", SELECT_NAME, SELECT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", FULLRESCAN_NAME, FULLRESCAN_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", RETRIES_NAME, RETRIES_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TIMEOUT_NAME, TIMEOUT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", UPLOADLIMIT_NAME, UPLOADLIMIT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", DOWNLOADLIMIT_NAME, DOWNLOADLIMIT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", PROGRESS_NAME, PROGRESS_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", BLOCKTREE_NAME, BLOCKTREE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", OUTPUT_NAME, OUTPUT_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", ADDR_NAME, ADDR_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", BASEDIR_NAME, BASEDIR_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", BLOCK_NAME, BLOCK_USAGE)
@@ -44,6 +116,22 @@ func main() {
 
 	// Parse command-line arguments and flags
 	debug := flag.Bool("d", false, DEBUG_USAGE)
+	token := flag.String(TOKEN_NAME, os.Getenv("SURFSTORE_TOKEN"), TOKEN_USAGE)
+	daemon := flag.Bool(DAEMON_NAME, false, DAEMON_USAGE)
+	debounce := flag.Duration(DEBOUNCE_NAME, surfstore.DefaultDaemonOptions().Debounce, DEBOUNCE_USAGE)
+	dryRun := flag.Bool(DRYRUN_NAME, false, DRYRUN_USAGE)
+	var excludes stringList
+	flag.Var(&excludes, EXCLUDE_NAME, EXCLUDE_USAGE)
+	var selection stringList
+	flag.Var(&selection, SELECT_NAME, SELECT_USAGE)
+	fullRescan := flag.Bool(FULLRESCAN_NAME, false, FULLRESCAN_USAGE)
+	retries := flag.Int(RETRIES_NAME, surfstore.DefaultRetryPolicy().MaxAttempts, RETRIES_USAGE)
+	timeout := flag.Duration(TIMEOUT_NAME, surfstore.DefaultRetryPolicy().Timeout, TIMEOUT_USAGE)
+	uploadLimit := flag.String(UPLOADLIMIT_NAME, "", UPLOADLIMIT_USAGE)
+	downloadLimit := flag.String(DOWNLOADLIMIT_NAME, "", DOWNLOADLIMIT_USAGE)
+	progress := flag.Bool(PROGRESS_NAME, isTerminal(os.Stderr), PROGRESS_USAGE)
+	blockTree := flag.Int(BLOCKTREE_NAME, 0, BLOCKTREE_USAGE)
+	output := flag.String(OUTPUT_NAME, "table", OUTPUT_USAGE)
 	flag.Parse()
 
 	// Use tail arguments to hold non-flag arguments
@@ -61,6 +149,21 @@ func main() {
 		flag.Usage()
 		os.Exit(EX_USAGE)
 	}
+	if (*output != "table" && *output != "json") || (*daemon && *dryRun) || *retries < 1 || *timeout < 0 || *blockTree < 0 {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+
+	uploadSchedule, err := surfstore.ParseRateSchedule(*uploadLimit)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EX_USAGE)
+	}
+	downloadSchedule, err := surfstore.ParseRateSchedule(*downloadLimit)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EX_USAGE)
+	}
 
 	// Disable log outputs if debug flag is missing
 	if !(*debug) {
@@ -69,5 +172,154 @@ func main() {
 	}
 
 	rpcClient := surfstore.NewSurfstoreRPCClient(hostPort, baseDir, blockSize)
-	surfstore.ClientSync(rpcClient)
+	rpcClient.Token = *token
+	rpcClient.Retry.MaxAttempts = *retries
+	rpcClient.MutationRetry.MaxAttempts = *retries
+	rpcClient.Retry.Timeout = *timeout
+	rpcClient.MutationRetry.Timeout = *timeout
+	rpcClient.UploadLimit = surfstore.NewRateLimiter(uploadSchedule)
+	rpcClient.DownloadLimit = surfstore.NewRateLimiter(downloadSchedule)
+	rpcClient.BlockTreeThreshold = *blockTree
+	syncOpts := surfstore.SyncOptions{DryRun: *dryRun, Excludes: excludes, FullRescan: *fullRescan}
+	if len(selection) > 0 {
+		syncOpts.Selection = selection
+	}
+
+	// Ctrl-C cancels the calls in flight, and a sync saves what it finished
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *daemon {
+		opts := surfstore.DefaultDaemonOptions()
+		opts.Debounce = *debounce
+		opts.Sync = syncOpts
+		if err := surfstore.RunDaemon(ctx, rpcClient, opts); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var bar *progressBar
+	if *progress && !*debug {
+		bar = &progressBar{w: os.Stderr}
+		syncOpts.Progress = bar
+	}
+	report, err := surfstore.ClientSync(ctx, rpcClient, syncOpts)
+	bar.Finish()
+	if *output == "json" {
+		report.WriteJSON(os.Stdout)
+	} else {
+		report.WriteTable(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// stringList collects the values of a repeated flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// exitCode maps a ClientSync error to a sysexits code
+func exitCode(err error) int {
+	if errors.Is(err, context.Canceled) {
+		return EX_INTERRUPTED
+	}
+
+	var partialErr *surfstore.PartialSyncError
+	if errors.As(err, &partialErr) {
+		return EX_TEMPFAIL
+	}
+
+	var stageErr *surfstore.SyncStageError
+	if !errors.As(err, &stageErr) {
+		return EX_SOFTWARE
+	}
+	switch stageErr.Stage {
+	case surfstore.STAGE_SCAN, surfstore.STAGE_INDEX:
+		return EX_IOERR
+	case surfstore.STAGE_SERVER:
+		if status.Code(stageErr.Err) == codes.PermissionDenied || status.Code(stageErr.Err) == codes.Unauthenticated {
+			return EX_NOPERM
+		}
+		return EX_UNAVAILABLE
+	}
+	return EX_SOFTWARE
+}
+
+// progressBar draws the progress of a sync on one terminal line
+type progressBar struct {
+	w     io.Writer
+	drawn time.Time
+	width int
+}
+
+const progressBarWidth = 30
+const progressRedrawInterval = 100 * time.Millisecond
+
+func (b *progressBar) ReportProgress(p surfstore.Progress) {
+	done := p.FilesDone == p.FilesTotal
+	if !done && time.Since(b.drawn) < progressRedrawInterval {
+		return
+	}
+	b.drawn = time.Now()
+
+	fraction := 1.0
+	if p.BytesTotal > 0 {
+		fraction = float64(p.BytesDone) / float64(p.BytesTotal)
+	} else if p.FilesTotal > 0 {
+		fraction = float64(p.FilesDone) / float64(p.FilesTotal)
+	}
+	filled := int(fraction * progressBarWidth)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+
+	line := fmt.Sprintf("[%s] %3.0f%%  %d/%d files  %s/%s  %s/s",
+		bar, fraction*100, p.FilesDone, p.FilesTotal,
+		formatBytes(p.BytesDone), formatBytes(p.BytesTotal), formatBytes(int64(p.Throughput)))
+	if p.ETA > 0 && !done {
+		line += fmt.Sprintf("  ETA %v", p.ETA.Round(time.Second))
+	}
+	// pad with spaces to overwrite a longer previous line
+	padding := ""
+	if len(line) < b.width {
+		padding = strings.Repeat(" ", b.width-len(line))
+	}
+	b.width = len(line)
+	fmt.Fprintf(b.w, "\r%s%s", line, padding)
+}
+
+// Finish ends the progress line, if one was drawn
+func (b *progressBar) Finish() {
+	if b != nil && b.width > 0 {
+		fmt.Fprintln(b.w)
+	}
+}
+
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	value, prefix := float64(bytes), 0
+	for value >= unit && prefix < 4 {
+		value /= unit
+		prefix++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGT"[prefix-1])
+}
+
+// isTerminal reports whether f is a character device such as a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
@@ -10,6 +10,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"google.golang.org/grpc"
 
@@ -17,7 +18,7 @@ import (
 )
 
 // Usage String
-const USAGE_STRING = "./run-server.sh -s <service_type> -p <port> -l -d (blockStoreAddr*)"
+const USAGE_STRING = "./run-server.sh -s <service_type> -p <port> -l -d -a <tokens.json> -q <quotas.json> -r <retention> -u <interval> -b <rate> -bs <default,min,max> (blockStoreAddr*)"
 
 // Set of valid services
 var SERVICE_TYPES = map[string]bool{"meta": true, "block": true, "both": true}
@@ -41,6 +42,12 @@ func main() {
 	port := flag.Int("p", 8080, "(default = 8080) Port to accept connections")
 	localOnly := flag.Bool("l", false, "Only listen on localhost")
 	debug := flag.Bool("d", false, "Output log statements")
+	tokenFile := flag.String("a", "", "JSON file with the token of every user, without it every caller is anonymous")
+	quotaFile := flag.String("q", "", "JSON file with per-user and per-namespace quotas")
+	retention := flag.Duration("r", 30*24*time.Hour, "How long deleted files can be restored before their tombstones are purged, 0 keeps them forever")
+	recalculate := flag.Duration("u", time.Hour, "How often physical usage is recalculated from the committed files, 0 never")
+	blockLimit := flag.String("b", "", "Per-client BlockStore bandwidth in bytes/s (K, M, G suffixes), optionally per time of day: 10M,09:00-18:00=1M")
+	blockSizes := flag.String("bs", "", "Block sizes clients may chunk files with, as default,min,max (default 4096,1,2097152)")
 	flag.Parse()
 
 	// Use tail arguments to hold BlockStore address
@@ -69,32 +76,89 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
-	log.Fatal(startServer(addr, strings.ToLower(*service), blockStoreAddr))
+	var auth *surfstore.Authenticator
+	if *tokenFile != "" {
+		var err error
+		if auth, err = surfstore.LoadAuthenticator(*tokenFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var quotas *surfstore.QuotaConfig
+	if *quotaFile != "" {
+		var err error
+		if quotas, err = surfstore.LoadQuotaConfig(*quotaFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	blockSchedule, err := surfstore.ParseRateSchedule(*blockLimit)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EX_USAGE)
+	}
+
+	blockSizeRange, err := parseBlockSizeRange(*blockSizes)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EX_USAGE)
+	}
+
+	log.Fatal(startServer(addr, strings.ToLower(*service), blockStoreAddr, auth, quotas, *retention, *recalculate, blockSchedule, blockSizeRange))
 }
 
-func startServer(hostAddr string, serviceType string, blockStoreAddr string) error {
+func startServer(hostAddr string, serviceType string, blockStoreAddr string, auth *surfstore.Authenticator, quotas *surfstore.QuotaConfig, retention time.Duration, recalculate time.Duration, blockLimit *surfstore.RateSchedule, blockSizes *surfstore.BlockSizeRange) error {
 	//panic("todo")
-	// Create a new RPC server
-	grpcServer := grpc.NewServer()
+	// Create a new RPC server, authenticating callers and pacing the
+	// BlockStore's clients by their verified user
+	limiter := surfstore.NewBlockRateLimiter(blockLimit)
+	grpcServer := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(auth.UnaryInterceptor(), limiter.UnaryInterceptor()),
+		grpc.StreamInterceptor(auth.StreamInterceptor()),
+	)
 	var metaStore *surfstore.MetaStore
 	var blockStore *surfstore.BlockStore
 
 	//register RPC Services
 	if serviceType == "both" {
 		metaStore = surfstore.NewMetaStore(blockStoreAddr)
+		metaStore.Quotas = quotas
+		metaStore.TombstoneRetention = retention
 		surfstore.RegisterMetaStoreServer(grpcServer, metaStore)
 		blockStore = surfstore.NewBlockStore()
+		blockStore.Quotas = quotas
+		blockStore.Permissions = metaStore
 		surfstore.RegisterBlockStoreServer(grpcServer, blockStore)
 	} else if serviceType == "meta" {
 		metaStore = surfstore.NewMetaStore(blockStoreAddr)
+		metaStore.Quotas = quotas
+		metaStore.TombstoneRetention = retention
 		surfstore.RegisterMetaStoreServer(grpcServer, metaStore)
 	} else if serviceType == "block" {
 		blockStore = surfstore.NewBlockStore()
+		blockStore.Quotas = quotas
 		surfstore.RegisterBlockStoreServer(grpcServer, blockStore)
 	} else {
 		return errors.New("Please enter a correct service type:")
 	}
 
+	if metaStore != nil {
+		metaStore.DefaultBlockSize = blockSizes.DefaultSize
+		metaStore.MinBlockSize = blockSizes.MinSize
+		metaStore.MaxBlockSize = blockSizes.MaxSize
+	}
+	if metaStore != nil && retention > 0 {
+		metaStore.StartTombstonePurger(purgeInterval(retention))
+	}
+	if metaStore != nil && blockStoreAddr != "" && recalculate > 0 {
+		metaStore.BlockStoreToken = auth.Token(surfstore.METASTORE_USER)
+		if metaStore.BlockStoreToken == "" {
+			log.Printf("no token for %s, physical usage is not recalculated\n", surfstore.METASTORE_USER)
+		} else {
+			metaStore.StartUsageRecalculator(recalculate)
+		}
+	}
+
 	//Start listening and serving
 	lis, err := net.Listen("tcp", hostAddr)
 	if err != nil {
@@ -105,3 +169,43 @@ func startServer(hostAddr string, serviceType string, blockStoreAddr string) err
 	}
 	return nil
 }
+
+// purgeInterval checks for expired tombstones often enough that they do not
+// outlive the retention by much, but at least hourly
+func purgeInterval(retention time.Duration) time.Duration {
+	if interval := retention / 10; interval < time.Hour {
+		return interval
+	}
+	return time.Hour
+}
+
+// parseBlockSizeRange parses default,min,max; an empty string keeps the
+// built-in range
+func parseBlockSizeRange(s string) (*surfstore.BlockSizeRange, error) {
+	blockSizes := &surfstore.BlockSizeRange{
+		DefaultSize: surfstore.DEFAULT_BLOCK_SIZE,
+		MinSize:     surfstore.MIN_BLOCK_SIZE,
+		MaxSize:     surfstore.MAX_BLOCK_SIZE,
+	}
+	if s == "" {
+		return blockSizes, nil
+	}
+
+	parts := strings.Split(s, ",")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid block sizes %q, want default,min,max", s)
+	}
+	var sizes [3]int32
+	for i, part := range parts {
+		size, err := strconv.ParseInt(part, 10, 32)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid block size %q", part)
+		}
+		sizes[i] = int32(size)
+	}
+	blockSizes.DefaultSize, blockSizes.MinSize, blockSizes.MaxSize = sizes[0], sizes[1], sizes[2]
+	if blockSizes.MinSize > blockSizes.DefaultSize || blockSizes.DefaultSize > blockSizes.MaxSize {
+		return nil, fmt.Errorf("block sizes %q are not ordered min <= default <= max", s)
+	}
+	return blockSizes, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"cse224/proj4/pkg/surfstore"
+	"flag"
+	"fmt"
+	"os"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Usage strings
+const USAGE_STRING = "./run-undelete.sh -t token host:port path"
+
+const TOKEN_USAGE = "Token the server knows your user by (default $SURFSTORE_TOKEN)"
+
+// Exit codes
+const EX_USAGE int = 64
+const EX_NOINPUT int = 66
+const EX_NOPERM int = 77
+
+func main() {
+	// Custom flag Usage message
+	flag.Usage = func() {
+		w := flag.CommandLine.Output()
+		fmt.Fprintf(w, "Usage of %s:\n", USAGE_STRING)
+		fmt.Fprintf(w, "  -t: %v\n", TOKEN_USAGE)
+		fmt.Fprintf(w, "  path: a deleted file whose tombstone has not been purged yet\n")
+	}
+
+	token := flag.String("t", os.Getenv("SURFSTORE_TOKEN"), TOKEN_USAGE)
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) != 2 {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+	hostPort, path := args[0], args[1]
+
+	rpcClient := surfstore.NewSurfstoreRPCClient(hostPort, "", 0)
+	rpcClient.Token = *token
+
+	var version int32
+	if err := rpcClient.UndeleteFile(context.Background(), path, &version); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if status.Code(err) == codes.NotFound {
+			os.Exit(EX_NOINPUT)
+		}
+		os.Exit(EX_NOPERM)
+	}
+	fmt.Printf("restored %s as version %d\n", path, version)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"cse224/proj4/pkg/surfstore"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Usage strings
+const USAGE_STRING = "./run-usage.sh -t token host:port [namespace]"
+
+const TOKEN_USAGE = "Token the server knows your user by (default $SURFSTORE_TOKEN)"
+
+// Exit codes
+const EX_USAGE int = 64
+const EX_UNAVAILABLE int = 69
+
+func main() {
+	// Custom flag Usage message
+	flag.Usage = func() {
+		w := flag.CommandLine.Output()
+		fmt.Fprintf(w, "Usage of %s:\n", USAGE_STRING)
+		fmt.Fprintf(w, "  -t: %v\n", TOKEN_USAGE)
+		fmt.Fprintf(w, "  namespace: top-level directory to report on\n")
+	}
+
+	token := flag.String("t", os.Getenv("SURFSTORE_TOKEN"), TOKEN_USAGE)
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) < 1 || len(args) > 2 {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+	namespace := ""
+	if len(args) == 2 {
+		namespace = args[1]
+	}
+
+	rpcClient := surfstore.NewSurfstoreRPCClient(args[0], "", 0)
+	rpcClient.Token = *token
+
+	var blockStoreAddr string
+	var report surfstore.UsageReport
+	if err := rpcClient.GetBlockStoreAddr(context.Background(), &blockStoreAddr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EX_UNAVAILABLE)
+	}
+	if err := rpcClient.GetUsage(context.Background(), "", namespace, blockStoreAddr, &report); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EX_UNAVAILABLE)
+	}
+
+	fmt.Printf("%-24s %16s %16s %16s %16s\n", "", "logical", "logical limit", "physical", "physical limit")
+	printUsage("user "+report.User, report.UserUsage)
+	printUsage("namespace "+report.Namespace, report.NamespaceUsage)
+}
+
+func printUsage(name string, usage *surfstore.Usage) {
+	fmt.Printf("%-24s %16d %16s %16d %16s\n", name,
+		usage.LogicalBytes, limitString(usage.LogicalLimit),
+		usage.PhysicalBytes, limitString(usage.PhysicalLimit))
+}
+
+func limitString(limit int64) string {
+	if limit == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprint(limit)
+}
@@ -0,0 +1,198 @@
+package surfstore
+
+import (
+	context "context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// DirectoryAcl holds the owner and access entries of a shared subtree.
+// Every file whose name starts with the directory prefix inherits them.
+type DirectoryAcl struct {
+	Owner string
+	Acl   []*AccessControlEntry
+}
+
+// userContextKey keys the user an Authenticator verified in a context
+type userContextKey struct{}
+
+// UserFromContext returns the user an Authenticator verified for an
+// incoming RPC, or "" for anonymous callers.
+func UserFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(userContextKey{}).(string)
+	return user
+}
+
+// Authenticator knows every user by a secret token, which clients send as
+// "Bearer <token>" in the authorization metadata. Callers without a token
+// are anonymous, callers with an unknown token are rejected. A server
+// without an Authenticator treats every caller as anonymous.
+type Authenticator struct {
+	// users by the SHA-256 of their token
+	users  map[[sha256.Size]byte]string
+	tokens map[string]string
+}
+
+// LoadAuthenticator reads a JSON file mapping user names to tokens, e.g.
+// {"alice": "s3cret", "bob": "hunter2"}
+func LoadAuthenticator(path string) (*Authenticator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make(map[string]string)
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, err
+	}
+	return NewAuthenticator(tokens)
+}
+
+// NewAuthenticator takes the token of every user
+func NewAuthenticator(tokens map[string]string) (*Authenticator, error) {
+	a := &Authenticator{users: make(map[[sha256.Size]byte]string), tokens: tokens}
+	for user, token := range tokens {
+		if user == "" || token == "" {
+			return nil, fmt.Errorf("user %q needs a name and a token", user)
+		}
+		hash := sha256.Sum256([]byte(token))
+		if other, ok := a.users[hash]; ok {
+			return nil, fmt.Errorf("users %q and %q have the same token", other, user)
+		}
+		a.users[hash] = user
+	}
+	return a, nil
+}
+
+// Token returns the token of a user, e.g. for the server to call another
+// server as METASTORE_USER, or "" if the user has none
+func (a *Authenticator) Token(user string) string {
+	if a == nil {
+		return ""
+	}
+	return a.tokens[user]
+}
+
+// authenticate returns ctx carrying the caller's verified user
+func (a *Authenticator) authenticate(ctx context.Context) (context.Context, error) {
+	if a == nil {
+		return ctx, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(AUTH_METADATA_KEY)
+	if len(values) == 0 {
+		return ctx, nil
+	}
+	token := strings.TrimPrefix(values[0], AUTH_SCHEME)
+	user, ok := a.users[sha256.Sum256([]byte(token))]
+	if !ok || token == values[0] {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	return context.WithValue(ctx, userContextKey{}, user), nil
+}
+
+// UnaryInterceptor authenticates every call before it is handled
+func (a *Authenticator) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := a.authenticate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor authenticates every stream before it is handled
+func (a *Authenticator) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := a.authenticate(ss.Context())
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// authenticatedStream is a server stream whose context carries the user
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// NamespaceFromContext returns the namespace a BlockStore call is made for
+func NamespaceFromContext(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if namespaces := md.Get(NAMESPACE_METADATA_KEY); len(namespaces) > 0 {
+		return namespaces[0]
+	}
+	return ""
+}
+
+// DirPrefix normalizes a directory path to the prefix form used as
+// the key of DirAclMap, e.g. "team/docs" becomes "team/docs/".
+func DirPrefix(path string) string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return ""
+	}
+	return path + "/"
+}
+
+// ParsePermission converts "read", "write" or "admin" to a Permission.
+func ParsePermission(s string) (Permission, bool) {
+	p, ok := Permission_value[strings.ToUpper(s)]
+	return Permission(p), ok
+}
+
+// aclPermission returns the highest permission the entries grant user.
+func aclPermission(user string, owner string, acl []*AccessControlEntry) Permission {
+	if user != "" && user == owner {
+		return Permission_ADMIN
+	}
+	perm := Permission_NONE
+	for _, entry := range acl {
+		if entry.Principal != user && entry.Principal != ANYONE_PRINCIPAL {
+			continue
+		}
+		if entry.Permission > perm {
+			perm = entry.Permission
+		}
+	}
+	return perm
+}
+
+// setAclEntry replaces the entry for principal, or appends a new one.
+func setAclEntry(acl []*AccessControlEntry, principal string, perm Permission) []*AccessControlEntry {
+	for _, entry := range acl {
+		if entry.Principal == principal {
+			entry.Permission = perm
+			return acl
+		}
+	}
+	return append(acl, &AccessControlEntry{Principal: principal, Permission: perm})
+}
+
+// removeAclEntry drops every entry for principal.
+func removeAclEntry(acl []*AccessControlEntry, principal string) []*AccessControlEntry {
+	kept := acl[:0]
+	for _, entry := range acl {
+		if entry.Principal != principal {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
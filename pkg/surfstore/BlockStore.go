@@ -2,54 +2,269 @@ package surfstore
 
 import (
 	context "context"
+	"io"
+	"log"
 	sync "sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type BlockStore struct {
 	BlockMap map[string]*Block
 	Mtx      *sync.RWMutex
 
+	// Unique blocks attributed to each user and namespace, and their bytes
+	UserBlocks      map[string]map[string]bool
+	NamespaceBlocks map[string]map[string]bool
+	UserUsage       map[string]int64
+	NamespaceUsage  map[string]int64
+	Quotas          *QuotaConfig
+
+	// Unreferenced are the stored blocks no committed file referred to at
+	// the last AttributeBlocks. Those still unused at the next one are
+	// deleted; uploading or asking for a block keeps it.
+	Unreferenced map[string]bool
+
+	// Permissions checks the namespace a client names for a block. Without
+	// it the BlockStore cannot tell whether the caller may write there, so
+	// uploads are only charged to the user and namespaces are left to
+	// AttributeBlocks.
+	Permissions PermissionChecker
+
 	UnimplementedBlockStoreServer
 }
 
+// PermissionChecker tells a BlockStore what a user may do with a path
+type PermissionChecker interface {
+	PermissionOf(user string, path string) Permission
+}
+
+// GetBlock returns the block with the hash. It does not check ACLs: the
+// BlockStore cannot tell which files refer to a block, so anyone who knows a
+// hash may fetch the block.
 func (bs *BlockStore) GetBlock(ctx context.Context, blockHash *BlockHash) (*Block, error) {
 	//panic("todo")
 	bs.Mtx.RLock()
 	defer bs.Mtx.RUnlock()
-	block := bs.BlockMap[blockHash.Hash]
+	block, ok := bs.BlockMap[blockHash.Hash]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "block %s not found", blockHash.Hash)
+	}
 	return block, nil
 }
 
 func (bs *BlockStore) PutBlock(ctx context.Context, block *Block) (*Success, error) {
 	//panic("todo")
 	hash := GetBlockHashString(block.BlockData)
+	user := UserFromContext(ctx)
+	namespace, err := bs.namespaceOf(ctx, user)
+	if err != nil {
+		return &Success{Flag: false}, err
+	}
 
 	bs.Mtx.Lock()
 	defer bs.Mtx.Unlock()
 
+	size := int64(len(block.BlockData))
+
+	userDelta, namespaceDelta := size, size
+	if bs.UserBlocks[user][hash] {
+		userDelta = 0
+	}
+	if bs.NamespaceBlocks[namespace][hash] {
+		namespaceDelta = 0
+	}
+	if limit := bs.Quotas.UserQuota(user).PhysicalBytes; exceeds(bs.UserUsage[user], userDelta, limit) {
+		return &Success{Flag: false}, status.Errorf(codes.ResourceExhausted, "user %q would exceed its quota of %d bytes", user, limit)
+	}
+	if limit := bs.Quotas.NamespaceQuota(namespace).PhysicalBytes; exceeds(bs.NamespaceUsage[namespace], namespaceDelta, limit) {
+		return &Success{Flag: false}, status.Errorf(codes.ResourceExhausted, "namespace %q would exceed its quota of %d bytes", namespace, limit)
+	}
+
+	if bs.UserBlocks[user] == nil {
+		bs.UserBlocks[user] = map[string]bool{}
+	}
+	if bs.NamespaceBlocks[namespace] == nil {
+		bs.NamespaceBlocks[namespace] = map[string]bool{}
+	}
+	bs.UserBlocks[user][hash] = true
+	bs.NamespaceBlocks[namespace][hash] = true
+	bs.UserUsage[user] += userDelta
+	bs.NamespaceUsage[namespace] += namespaceDelta
+
 	bs.BlockMap[hash] = block
+	delete(bs.Unreferenced, hash)
 
 	return &Success{Flag: true}, nil
 }
 
+// namespaceOf returns the namespace a PutBlock is charged to: the one the
+// client names if the caller may write to it, and none if the BlockStore
+// cannot check
+func (bs *BlockStore) namespaceOf(ctx context.Context, user string) (string, error) {
+	namespace := NamespaceFromContext(ctx)
+	if namespace == "" || bs.Permissions == nil {
+		return "", nil
+	}
+	if bs.Permissions.PermissionOf(user, DirPrefix(namespace)) < Permission_WRITE {
+		return "", status.Errorf(codes.PermissionDenied, "user %q may not write namespace %q", user, namespace)
+	}
+	return namespace, nil
+}
+
 // Given a list of hashes “in”, returns a list containing the
-// subset of in that are stored in the key-value store
+// subset of in that are stored in the key-value store. The blocks are
+// about to be committed, so they are no longer unreferenced.
 func (bs *BlockStore) HasBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockHashes, error) {
 	//panic("todo")
-	bs.Mtx.RLock()
-	defer bs.Mtx.RUnlock()
+	bs.Mtx.Lock()
+	defer bs.Mtx.Unlock()
 
 	var hashout BlockHashes
 	for _, hash := range blockHashesIn.Hashes {
 		_, exists := bs.BlockMap[hash]
 		if exists {
 			hashout.Hashes = append(hashout.Hashes, hash)
+			delete(bs.Unreferenced, hash)
 		}
 	}
 
 	return &hashout, nil
 }
 
+// GetUsage reports the physical bytes attributed to the caller and a
+// namespace. The user in the request has to be empty or the caller, and
+// the caller has to be allowed to read the namespace. Without Permissions
+// the namespace's usage is left empty.
+func (bs *BlockStore) GetUsage(ctx context.Context, req *UsageRequest) (*UsageReport, error) {
+	user := UserFromContext(ctx)
+	if req.User != "" && req.User != user {
+		return nil, status.Errorf(codes.PermissionDenied, "user %q may not see the usage of %q", user, req.User)
+	}
+	if req.Namespace != "" && bs.Permissions != nil && bs.Permissions.PermissionOf(user, DirPrefix(req.Namespace)) < Permission_READ {
+		return nil, status.Errorf(codes.PermissionDenied, "user %q may not read namespace %q", user, req.Namespace)
+	}
+
+	bs.Mtx.RLock()
+	defer bs.Mtx.RUnlock()
+
+	report := &UsageReport{
+		User: user,
+		UserUsage: &Usage{
+			PhysicalBytes: bs.UserUsage[user],
+			PhysicalLimit: bs.Quotas.UserQuota(user).PhysicalBytes,
+		},
+		Namespace:      req.Namespace,
+		NamespaceUsage: &Usage{},
+	}
+	if req.Namespace == "" || bs.Permissions != nil {
+		report.NamespaceUsage.PhysicalBytes = bs.NamespaceUsage[req.Namespace]
+		report.NamespaceUsage.PhysicalLimit = bs.Quotas.NamespaceQuota(req.Namespace).PhysicalBytes
+	}
+	return report, nil
+}
+
+// AttributeBlocks replaces the attribution of blocks to users and
+// namespaces, which PutBlock charges to whoever uploads a block and to the
+// namespace the client names, with the blocks the MetaStore's committed
+// files refer to. Blocks no file refers to stay charged as before, and are
+// deleted if they were unreferenced at the last call too and nobody used
+// them since. Only the MetaStore may call it.
+func (bs *BlockStore) AttributeBlocks(stream BlockStore_AttributeBlocksServer) error {
+	if user := UserFromContext(stream.Context()); user != METASTORE_USER {
+		return status.Errorf(codes.PermissionDenied, "user %q may not attribute blocks", user)
+	}
+
+	userBlocks := map[string]map[string]bool{}
+	namespaceBlocks := map[string]map[string]bool{}
+	for {
+		attribution, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if userBlocks[attribution.Owner] == nil {
+			userBlocks[attribution.Owner] = map[string]bool{}
+		}
+		if namespaceBlocks[attribution.Namespace] == nil {
+			namespaceBlocks[attribution.Namespace] = map[string]bool{}
+		}
+		for _, hash := range attribution.Hashes {
+			userBlocks[attribution.Owner][hash] = true
+			namespaceBlocks[attribution.Namespace][hash] = true
+		}
+	}
+
+	bs.Mtx.Lock()
+	defer bs.Mtx.Unlock()
+	referenced := map[string]bool{}
+	for _, hashes := range userBlocks {
+		for hash := range hashes {
+			referenced[hash] = true
+		}
+	}
+	unreferenced := map[string]bool{}
+	deleted := 0
+	for hash := range bs.BlockMap {
+		if referenced[hash] {
+			continue
+		}
+		if bs.Unreferenced[hash] {
+			delete(bs.BlockMap, hash)
+			deleted++
+			continue
+		}
+		unreferenced[hash] = true
+	}
+	bs.Unreferenced = unreferenced
+	if deleted > 0 {
+		log.Printf("[BlockStore] deleted %d unreferenced blocks\n", deleted)
+	}
+
+	// uploads that are not committed yet keep counting against the uploader
+	carryUnreferenced(userBlocks, bs.UserBlocks, unreferenced)
+	carryUnreferenced(namespaceBlocks, bs.NamespaceBlocks, unreferenced)
+	bs.UserBlocks, bs.UserUsage = bs.usageOf(userBlocks)
+	bs.NamespaceBlocks, bs.NamespaceUsage = bs.usageOf(namespaceBlocks)
+	return stream.SendAndClose(&Success{Flag: true})
+}
+
+// carryUnreferenced adds the unreferenced blocks of the old attribution to
+// the new one
+func carryUnreferenced(attributed map[string]map[string]bool, old map[string]map[string]bool, unreferenced map[string]bool) {
+	for key, hashes := range old {
+		for hash := range hashes {
+			if !unreferenced[hash] {
+				continue
+			}
+			if attributed[key] == nil {
+				attributed[key] = map[string]bool{}
+			}
+			attributed[key][hash] = true
+		}
+	}
+}
+
+// usageOf drops the hashes of blocks that are not stored and sums the bytes
+// of the others
+func (bs *BlockStore) usageOf(attributed map[string]map[string]bool) (map[string]map[string]bool, map[string]int64) {
+	usage := map[string]int64{}
+	for key, hashes := range attributed {
+		for hash := range hashes {
+			block, ok := bs.BlockMap[hash]
+			if !ok {
+				delete(hashes, hash)
+				continue
+			}
+			usage[key] += int64(len(block.BlockData))
+		}
+	}
+	return attributed, usage
+}
+
 // This line guarantees all method for BlockStore are implemented
 var _ BlockStoreInterface = new(BlockStore)
 
@@ -57,5 +272,11 @@ func NewBlockStore() *BlockStore {
 	return &BlockStore{
 		BlockMap: map[string]*Block{},
 		Mtx:      &sync.RWMutex{},
+
+		UserBlocks:      map[string]map[string]bool{},
+		NamespaceBlocks: map[string]map[string]bool{},
+		UserUsage:       map[string]int64{},
+		NamespaceUsage:  map[string]int64{},
+		Unreferenced:    map[string]bool{},
 	}
 }
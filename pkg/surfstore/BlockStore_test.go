@@ -0,0 +1,234 @@
+package surfstore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// userContext is the context of a call an Authenticator verified for user
+func userContext(user string) context.Context {
+	return context.WithValue(context.Background(), userContextKey{}, user)
+}
+
+// putBlock stores data as user, naming namespace for it
+func putBlock(t *testing.T, bs *BlockStore, user string, namespace string, data string) error {
+	ctx := metadata.NewIncomingContext(userContext(user), metadata.Pairs(NAMESPACE_METADATA_KEY, namespace))
+	_, err := bs.PutBlock(ctx, &Block{BlockData: []byte(data), BlockSize: int32(len(data))})
+	return err
+}
+
+func TestPutBlockNamespacePermission(t *testing.T) {
+	m := NewMetaStore("")
+	m.DirAclMap["team/"] = &DirectoryAcl{Owner: "alice", Acl: []*AccessControlEntry{{Principal: "bob", Permission: Permission_READ}}}
+	bs := NewBlockStore()
+	bs.Permissions = m
+
+	tests := []struct {
+		name      string
+		user      string
+		namespace string
+		want      codes.Code
+	}{
+		{"owner", "alice", "team", codes.OK},
+		{"reader", "bob", "team", codes.PermissionDenied},
+		{"stranger", "carol", "team", codes.PermissionDenied},
+		{"ungoverned namespace", "carol", "other", codes.OK},
+		{"no namespace", "carol", "", codes.OK},
+	}
+	for _, tt := range tests {
+		err := putBlock(t, bs, tt.user, tt.namespace, tt.name)
+		if got := status.Code(err); got != tt.want {
+			t.Errorf("%s: PutBlock = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if got := bs.NamespaceUsage["team"]; got != int64(len("owner")) {
+		t.Errorf("team is charged %d bytes, want only the owner's %d", got, len("owner"))
+	}
+
+	// a BlockStore that cannot check permissions charges no namespace
+	alone := NewBlockStore()
+	if err := putBlock(t, alone, "carol", "team", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if got := alone.NamespaceUsage["team"]; got != 0 {
+		t.Errorf("a BlockStore without permissions charged team %d bytes", got)
+	}
+}
+
+func TestBlockStoreGetUsageNamespacePermission(t *testing.T) {
+	m := NewMetaStore("")
+	m.DirAclMap["team/"] = &DirectoryAcl{Owner: "alice", Acl: []*AccessControlEntry{{Principal: "bob", Permission: Permission_READ}}}
+	bs := NewBlockStore()
+	bs.Permissions = m
+
+	tests := []struct {
+		user string
+		want codes.Code
+	}{
+		{"alice", codes.OK},
+		{"bob", codes.OK},
+		{"carol", codes.PermissionDenied},
+	}
+	for _, tt := range tests {
+		_, err := bs.GetUsage(userContext(tt.user), &UsageRequest{Namespace: "team"})
+		if got := status.Code(err); got != tt.want {
+			t.Errorf("GetUsage of team as %s = %v, want %v", tt.user, got, tt.want)
+		}
+	}
+
+	// a BlockStore that cannot check permissions does not tell
+	alone := NewBlockStore()
+	alone.NamespaceUsage["team"] = 10
+	report, err := alone.GetUsage(userContext("carol"), &UsageRequest{Namespace: "team"})
+	if err != nil || report.NamespaceUsage.PhysicalBytes != 0 {
+		t.Errorf("GetUsage of team without permissions = %v, %v, want no namespace usage", report, err)
+	}
+}
+
+func TestRecalculateUsageDeletesUncommittedBlocks(t *testing.T) {
+	auth, err := NewAuthenticator(map[string]string{METASTORE_USER: "meta-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, m, bs := startTestServer(t, grpc.UnaryInterceptor(auth.UnaryInterceptor()), grpc.StreamInterceptor(auth.StreamInterceptor()))
+	m.BlockStoreToken = "meta-token"
+	ctx := context.Background()
+
+	if err := putBlock(t, bs, "alice", "", "committed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := putBlock(t, bs, "alice", "", "abandoned"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.UpdateFile(userContext("alice"), &FileMetaData{Filename: "f", Version: 1, BlockHashList: []string{GetBlockHashString([]byte("committed"))}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the uncommitted block keeps counting for one interval
+	if err := m.RecalculateUsage(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := bs.UserUsage["alice"], int64(len("committed")+len("abandoned")); got != want {
+		t.Errorf("after one recalculation alice uses %d bytes, want %d", got, want)
+	}
+
+	// and is deleted at the next one
+	if err := m.RecalculateUsage(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := bs.UserUsage["alice"], int64(len("committed")); got != want {
+		t.Errorf("after two recalculations alice uses %d bytes, want %d", got, want)
+	}
+	if _, ok := bs.BlockMap[GetBlockHashString([]byte("abandoned"))]; ok {
+		t.Error("the uncommitted block was not deleted")
+	}
+	if _, ok := bs.BlockMap[GetBlockHashString([]byte("committed"))]; !ok {
+		t.Error("the committed block was deleted")
+	}
+}
+
+func TestUpdateFileRechecksBlocksAfterRecalculation(t *testing.T) {
+	auth, err := NewAuthenticator(map[string]string{METASTORE_USER: "meta-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two recalculations run while the first block check is under way, which
+	// deletes the block since no file refers to it yet
+	var m *MetaStore
+	checks := 0
+	_, m, bs := startTestServer(t, grpc.ChainUnaryInterceptor(auth.UnaryInterceptor(), func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		if info.FullMethod == "/surfstore.BlockStore/HasBlocks" {
+			checks++
+			if checks == 1 {
+				for i := 0; i < 2; i++ {
+					if err := m.RecalculateUsage(context.Background()); err != nil {
+						t.Errorf("recalculation during the check: %v", err)
+					}
+				}
+			}
+		}
+		return resp, err
+	}), grpc.StreamInterceptor(auth.StreamInterceptor()))
+	m.BlockStoreToken = "meta-token"
+
+	if err := putBlock(t, bs, "alice", "", "late"); err != nil {
+		t.Fatal(err)
+	}
+	hash := GetBlockHashString([]byte("late"))
+	_, err = m.UpdateFile(userContext("alice"), &FileMetaData{Filename: "f", Version: 1, BlockHashList: []string{hash}})
+	if got := MissingBlocks(err); !reflect.DeepEqual(got, []string{hash}) {
+		t.Errorf("UpdateFile = %v, want the deleted block reported missing", err)
+	}
+	if checks != 2 {
+		t.Errorf("the blocks were checked %d times, want 2", checks)
+	}
+	if _, ok := m.FileMetaMap["f"]; ok {
+		t.Error("f was committed without its block")
+	}
+}
+
+func TestRecalculateUsageKeepsBlocksInUse(t *testing.T) {
+	auth, err := NewAuthenticator(map[string]string{METASTORE_USER: "meta-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, m, bs := startTestServer(t, grpc.UnaryInterceptor(auth.UnaryInterceptor()), grpc.StreamInterceptor(auth.StreamInterceptor()))
+	m.BlockStoreToken = "meta-token"
+	ctx := context.Background()
+
+	if err := putBlock(t, bs, "alice", "", "pending"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RecalculateUsage(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// a client asking about the block before committing it keeps it
+	hash := GetBlockHashString([]byte("pending"))
+	if _, err := bs.HasBlocks(ctx, &BlockHashes{Hashes: []string{hash}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RecalculateUsage(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bs.BlockMap[hash]; !ok {
+		t.Error("a block asked about since the last recalculation was deleted")
+	}
+}
+
+func TestRecalculateUsageSkipsBrokenBlockTrees(t *testing.T) {
+	auth, err := NewAuthenticator(map[string]string{METASTORE_USER: "meta-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, m, bs := startTestServer(t, grpc.UnaryInterceptor(auth.UnaryInterceptor()), grpc.StreamInterceptor(auth.StreamInterceptor()))
+	m.BlockStoreToken = "meta-token"
+	ctx := context.Background()
+
+	for _, data := range []string{"committed", "not an index block"} {
+		if err := putBlock(t, bs, "alice", "", data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.putFileLocked(&FileMetaData{Filename: "missing", Owner: "alice", Version: 1, BlockTreeRoot: GetBlockHashString([]byte("gone"))})
+	m.putFileLocked(&FileMetaData{Filename: "malformed", Owner: "alice", Version: 1, BlockTreeRoot: GetBlockHashString([]byte("not an index block"))})
+	m.putFileLocked(&FileMetaData{Filename: "good", Owner: "alice", Version: 1, BlockHashList: []string{GetBlockHashString([]byte("committed"))}})
+
+	for i := 0; i < 2; i++ {
+		if err := m.RecalculateUsage(ctx); err != nil {
+			t.Fatalf("recalculation %d: %v", i+1, err)
+		}
+	}
+	if got, want := bs.UserUsage["alice"], int64(len("committed")); got != want {
+		t.Errorf("alice uses %d bytes, want the good file's %d", got, want)
+	}
+	if _, ok := bs.BlockMap[GetBlockHashString([]byte("committed"))]; !ok {
+		t.Error("the block of the good file was deleted")
+	}
+}
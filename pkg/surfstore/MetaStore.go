@@ -2,9 +2,20 @@ package surfstore
 
 import (
 	context "context"
-	"fmt"
+	"encoding/base64"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
@@ -13,52 +24,1063 @@ var muMetaUpdate sync.Mutex
 
 type MetaStore struct {
 	FileMetaMap    map[string]*FileMetaData
+	DirAclMap      map[string]*DirectoryAcl
+	UserUsage      map[string]int64
+	NamespaceUsage map[string]int64
+	Quotas         *QuotaConfig
 	BlockStoreAddr string
-	Mutex          sync.Mutex
+	// BlockStoreToken authenticates the MetaStore to the BlockStore as
+	// METASTORE_USER, for RecalculateUsage
+	BlockStoreToken string
+
+	// Files are chunked with a block size in [MinBlockSize, MaxBlockSize],
+	// clients that do not pick one use DefaultBlockSize
+	DefaultBlockSize int32
+	MinBlockSize     int32
+	MaxBlockSize     int32
+
+	// Every change to a file takes the next sequence number. ChangeLog[i]
+	// is the file changed at sequence number TrimmedSeq+i+1; the older
+	// entries were trimmed, and clients behind TrimmedSeq get the full
+	// FileInfoMap. The epoch changes when the MetaStore restarts, since its
+	// sequence numbers start over.
+	Epoch      string
+	Seq        int64
+	ChangeLog  []string
+	TrimmedSeq int64
+
+	// Tombstones are purged once they are older than TombstoneRetention,
+	// zero keeps them forever. PurgedSeq is the latest sequence number of
+	// a purged tombstone, clients behind it get the full FileInfoMap.
+	TombstoneRetention time.Duration
+	PurgedSeq          int64
+
+	// the name of every file in FileMetaMap, sorted, so ListFiles finds a
+	// page without sorting the whole map
+	fileNames []string
+
+	// closed and replaced on every change to wake up WatchFiles streams
+	changed chan struct{}
+	Mutex   sync.Mutex
+	// counts the snapshots RecalculateUsage took, see lockWithBlocks
+	recalculations int64
+
+	// connection to the BlockStore, for checking that blocks exist
+	blockStoreConn *grpc.ClientConn
+	blockStoreMu   sync.Mutex
 	UnimplementedMetaStoreServer
 }
 
+// GetFileInfoMap only returns the files the caller is allowed to read
 func (m *MetaStore) GetFileInfoMap(ctx context.Context, _ *emptypb.Empty) (*FileInfoMap, error) {
 	m.Mutex.Lock()
 	defer m.Mutex.Unlock()
 
-	return &FileInfoMap{FileInfoMap: m.FileMetaMap}, nil
+	user := UserFromContext(ctx)
+	fileInfoMap := make(map[string]*FileMetaData)
+	for fileName, meta := range m.FileMetaMap {
+		if m.permissionLocked(user, fileName) >= Permission_READ {
+			fileInfoMap[fileName] = meta
+		}
+	}
+
+	return &FileInfoMap{FileInfoMap: fileInfoMap}, nil
 }
 
 func (m *MetaStore) UpdateFile(ctx context.Context, fileMetaData *FileMetaData) (*Version, error) {
-	m.Mutex.Lock()
+	normalizeTombstone(fileMetaData)
+
+	if err := m.lockWithBlocks(ctx, referencedBlocks(fileMetaData)); err != nil {
+		return &Version{
+			Version: -1,
+		}, err
+	}
+	defer m.Mutex.Unlock()
+
+	user := UserFromContext(ctx)
+	if err := m.checkUpdateLocked(user, fileMetaData, nil, newStagedUsage()); err != nil {
+		return &Version{
+			Version: -1,
+		}, err
+	}
+	meta := m.applyUpdateLocked(user, fileMetaData)
+
+	return &Version{
+		Version: meta.Version,
+	}, nil
+}
+
+// UpdateFiles commits a batch of files all-or-nothing. Every file is
+// checked like in UpdateFile before any is applied, and the first failure
+// rejects the whole batch. It returns the committed metadata of every file.
+func (m *MetaStore) UpdateFiles(ctx context.Context, batch *FileInfoMap) (*FileInfoMap, error) {
+	var hashes []string
+	for fileName, fileMetaData := range batch.FileInfoMap {
+		if fileMetaData == nil || fileMetaData.Filename != fileName {
+			return nil, status.Errorf(codes.InvalidArgument, "batch entry %s does not hold the metadata of %s", fileName, fileName)
+		}
+		normalizeTombstone(fileMetaData)
+		hashes = append(hashes, referencedBlocks(fileMetaData)...)
+	}
+
+	if err := m.lockWithBlocks(ctx, hashes); err != nil {
+		return nil, err
+	}
 	defer m.Mutex.Unlock()
 
+	// apply in name order, so the sequence numbers do not depend on map order
+	fileNames := make([]string, 0, len(batch.FileInfoMap))
+	for fileName := range batch.FileInfoMap {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+
+	user := UserFromContext(ctx)
+	staged := newStagedUsage()
+	for _, fileName := range fileNames {
+		if err := m.checkUpdateLocked(user, batch.FileInfoMap[fileName], batch.FileInfoMap, staged); err != nil {
+			return nil, err
+		}
+	}
+
+	committed := &FileInfoMap{FileInfoMap: make(map[string]*FileMetaData)}
+	for _, fileName := range fileNames {
+		meta := m.applyUpdateLocked(user, batch.FileInfoMap[fileName])
+		committed.FileInfoMap[fileName] = proto.Clone(meta).(*FileMetaData)
+	}
+	return committed, nil
+}
+
+// stagedUsage adds up the quota changes of the updates checked so far in
+// a batch, which are not applied yet
+type stagedUsage struct {
+	users      map[string]int64
+	namespaces map[string]int64
+}
+
+func newStagedUsage() *stagedUsage {
+	return &stagedUsage{users: make(map[string]int64), namespaces: make(map[string]int64)}
+}
+
+// checkUpdateLocked checks whether user may commit an update on top of the
+// current metadata and the updates already staged, and stages its usage.
+// batch holds the other files committed along with it, if any.
+func (m *MetaStore) checkUpdateLocked(user string, fileMetaData *FileMetaData, batch map[string]*FileMetaData, staged *stagedUsage) error {
 	fileName := fileMetaData.Filename
-	if meta, exists := m.FileMetaMap[fileName]; exists {
-		if fileMetaData.Version-meta.Version < 0 {
-			return &Version{
-				Version: -1,
-			}, fmt.Errorf("file version error: should be %d but %d", meta.Version+1, fileMetaData.Version)
+	if err := ValidFileName(fileName); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if m.permissionLocked(user, fileName) < Permission_WRITE {
+		return status.Errorf(codes.PermissionDenied, "user %q may not write %s", user, fileName)
+	}
+	if size := fileMetaData.BlockSize; size != 0 && (size < m.MinBlockSize || size > m.MaxBlockSize) {
+		return status.Errorf(codes.InvalidArgument, "block size %d of %s is outside [%d, %d]", size, fileName, m.MinBlockSize, m.MaxBlockSize)
+	}
+	if fileMetaData.BlockTreeRoot != "" && len(fileMetaData.BlockHashList) > 0 {
+		return status.Errorf(codes.InvalidArgument, "%s has both a block list and a block tree", fileName)
+	}
+	if !fileMetaData.Deleted {
+		if err := m.checkNameClashLocked(fileName, batch); err != nil {
+			return err
 		}
-		(*meta).Version += 1
-		(*meta).BlockHashList = fileMetaData.BlockHashList
+	}
+
+	// an update is based on the current version, so two clients editing
+	// the same version cannot both commit. A new file, or one recreated by
+	// a client that never saw its tombstone, starts at version 1.
+	owner := user
+	var oldSize int64
+	meta, exists := m.FileMetaMap[fileName]
+	switch {
+	case !exists && fileMetaData.Version != 1:
+		return status.Errorf(codes.FailedPrecondition, "file version error: should be 1 but %d", fileMetaData.Version)
+	case exists && fileMetaData.Version != meta.Version+1 && !(meta.Deleted && !fileMetaData.Deleted && fileMetaData.Version == 1):
+		return status.Errorf(codes.FailedPrecondition, "file version error: should be %d but %d", meta.Version+1, fileMetaData.Version)
+	case exists:
+		owner = meta.Owner
+		oldSize = liveSize(meta)
+	}
+
+	delta := liveSize(fileMetaData) - oldSize
+	namespace := NamespaceOf(fileName)
+	if err := m.checkQuotaLocked(owner, namespace, staged.users[owner]+delta, staged.namespaces[namespace]+delta); err != nil {
+		return err
+	}
+	staged.users[owner] += delta
+	staged.namespaces[namespace] += delta
+	return nil
+}
+
+// checkNameClashLocked rejects a file named like the directory of another
+// live file, or inside a directory named like one, e.g. "a" next to "a/b".
+// No client could create both. The files of batch are taken as committed.
+func (m *MetaStore) checkNameClashLocked(fileName string, batch map[string]*FileMetaData) error {
+	live := func(name string) bool {
+		if meta, ok := batch[name]; ok {
+			return !meta.Deleted
+		}
+		meta, ok := m.FileMetaMap[name]
+		return ok && !isTombstone(meta)
+	}
+
+	for i := 0; i < len(fileName); i++ {
+		if fileName[i] == '/' && live(fileName[:i]) {
+			return status.Errorf(codes.InvalidArgument, "%s is inside %s, which is a file", fileName, fileName[:i])
+		}
+	}
+
+	prefix := fileName + "/"
+	for i := sort.SearchStrings(m.fileNames, prefix); i < len(m.fileNames) && strings.HasPrefix(m.fileNames[i], prefix); i++ {
+		if live(m.fileNames[i]) {
+			return status.Errorf(codes.InvalidArgument, "%s is a directory holding %s", fileName, m.fileNames[i])
+		}
+	}
+	for name := range batch {
+		if strings.HasPrefix(name, prefix) && live(name) {
+			return status.Errorf(codes.InvalidArgument, "%s is a directory holding %s", fileName, name)
+		}
+	}
+	return nil
+}
+
+// applyUpdateLocked commits an update that checkUpdateLocked accepted and
+// returns the file's new metadata
+func (m *MetaStore) applyUpdateLocked(user string, fileMetaData *FileMetaData) *FileMetaData {
+	fileName := fileMetaData.Filename
+	owner := user
+	var oldSize int64
+	meta, exists := m.FileMetaMap[fileName]
+	if exists {
+		owner = meta.Owner
+		oldSize = liveSize(meta)
+	}
+	delta := liveSize(fileMetaData) - oldSize
+	m.UserUsage[owner] += delta
+	m.NamespaceUsage[NamespaceOf(fileName)] += delta
 
+	if exists {
+		(*meta).Version += 1
+		(*meta).RenamedFrom = ""
+		if fileMetaData.Deleted {
+			// the tombstone keeps the last content, so it can be undeleted
+			if !meta.Deleted {
+				markDeleted(meta, user)
+			}
+		} else {
+			(*meta).BlockHashList = fileMetaData.BlockHashList
+			(*meta).Size = fileMetaData.Size
+			(*meta).Mode = fileMetaData.Mode
+			(*meta).ModTime = fileMetaData.ModTime
+			(*meta).SymlinkTarget = fileMetaData.SymlinkTarget
+			(*meta).BlockSize = fileMetaData.BlockSize
+			(*meta).ContentHash = fileMetaData.ContentHash
+			(*meta).BlockTreeRoot = fileMetaData.BlockTreeRoot
+			(*meta).Deleted = false
+			(*meta).DeletedAt = 0
+			(*meta).DeletedBy = ""
+		}
 	} else {
-		m.FileMetaMap[fileName] = fileMetaData
+		// the creator owns a new file, the ACL is only changed by GrantAccess
+		fileMetaData.Owner = user
+		fileMetaData.Acl = nil
+		fileMetaData.RenamedFrom = ""
+		fileMetaData.DeletedAt = 0
+		fileMetaData.DeletedBy = ""
+		if fileMetaData.Deleted {
+			markDeleted(fileMetaData, user)
+		}
+		m.putFileLocked(fileMetaData)
 	}
+	m.recordChangeLocked(m.FileMetaMap[fileName])
+	return m.FileMetaMap[fileName]
+}
 
-	return &Version{
-		Version: m.FileMetaMap[fileName].Version,
-	}, nil
+// referencedBlocks returns the blocks an update needs on the BlockStore.
+// Tombstones and symlinks need none. Of a block tree only the root is
+// checked; clients store it last, after every block below it.
+func referencedBlocks(meta *FileMetaData) []string {
+	if meta.Deleted || meta.SymlinkTarget != "" {
+		return nil
+	}
+	if meta.BlockTreeRoot != "" {
+		return []string{meta.BlockTreeRoot}
+	}
+	return meta.BlockHashList
+}
+
+// RenameFile moves a file's metadata, owner and ACL to a new name and leaves
+// a tombstone behind, in one step. The new file records where it came from
+// so other clients can rename their copy instead of downloading it again.
+// Only the mode and modification time may change along the way. It returns
+// the new metadata of both names.
+func (m *MetaStore) RenameFile(ctx context.Context, req *RenameRequest) (*FileInfoMap, error) {
+	if req.To == nil || req.From == "" || req.To.Filename == "" || req.From == req.To.Filename {
+		return nil, status.Error(codes.InvalidArgument, "rename needs two different file names")
+	}
+	if err := ValidFileName(req.To.Filename); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	user := UserFromContext(ctx)
+	from, to := req.From, req.To.Filename
+	for _, fileName := range []string{from, to} {
+		if m.permissionLocked(user, fileName) < Permission_WRITE {
+			return nil, status.Errorf(codes.PermissionDenied, "user %q may not write %s", user, fileName)
+		}
+	}
+
+	oldMeta, exists := m.FileMetaMap[from]
+	if !exists || isTombstone(oldMeta) {
+		return nil, status.Errorf(codes.NotFound, "no file %s", from)
+	}
+	// like an update, a rename is based on the current version of the file
+	if req.FromVersion != oldMeta.Version {
+		return nil, status.Errorf(codes.FailedPrecondition, "file version error: should be %d but %d", oldMeta.Version, req.FromVersion)
+	}
+	if oldMeta.SymlinkTarget != req.To.SymlinkTarget || !sameHashes(oldMeta, req.To) {
+		return nil, status.Errorf(codes.InvalidArgument, "%s does not have the content of %s", to, from)
+	}
+	version := oldMeta.Version
+	if meta, exists := m.FileMetaMap[to]; exists {
+		if !isTombstone(meta) {
+			return nil, status.Errorf(codes.FailedPrecondition, "file %s already exists", to)
+		}
+		if meta.Version > version {
+			version = meta.Version
+		}
+	}
+	// the old name is gone once the rename commits
+	if err := m.checkNameClashLocked(to, map[string]*FileMetaData{from: {Filename: from, Deleted: true}}); err != nil {
+		return nil, err
+	}
+
+	// the owner keeps the bytes, but they may move to another namespace
+	if NamespaceOf(from) != NamespaceOf(to) {
+		namespace := NamespaceOf(to)
+		if limit := m.Quotas.NamespaceQuota(namespace).LogicalBytes; exceeds(m.NamespaceUsage[namespace], oldMeta.Size, limit) {
+			return nil, status.Errorf(codes.ResourceExhausted, "namespace %q would exceed its quota of %d bytes", namespace, limit)
+		}
+		m.NamespaceUsage[NamespaceOf(from)] -= oldMeta.Size
+		m.NamespaceUsage[namespace] += oldMeta.Size
+	}
+
+	newMeta := proto.Clone(oldMeta).(*FileMetaData)
+	newMeta.Filename = to
+	newMeta.Version = version + 1
+	newMeta.Mode = req.To.Mode
+	newMeta.ModTime = req.To.ModTime
+	newMeta.RenamedFrom = from
+	m.putFileLocked(newMeta)
+
+	oldMeta.Version++
+	oldMeta.RenamedFrom = ""
+	markDeleted(oldMeta, user)
+
+	m.recordChangeLocked(oldMeta)
+	m.recordChangeLocked(newMeta)
+
+	return &FileInfoMap{FileInfoMap: map[string]*FileMetaData{
+		from: proto.Clone(oldMeta).(*FileMetaData),
+		to:   proto.Clone(newMeta).(*FileMetaData),
+	}}, nil
+}
+
+// UndeleteFile restores a deleted file to the content it had when it was
+// deleted, as long as its tombstone is within the retention window. The
+// restored file gets a new version, so every client downloads it again.
+func (m *MetaStore) UndeleteFile(ctx context.Context, req *UndeleteRequest) (*Version, error) {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	user := UserFromContext(ctx)
+	if m.permissionLocked(user, req.Filename) < Permission_WRITE {
+		return &Version{Version: -1}, status.Errorf(codes.PermissionDenied, "user %q may not write %s", user, req.Filename)
+	}
+	meta, exists := m.FileMetaMap[req.Filename]
+	if !exists || !meta.Deleted || m.expiredLocked(meta, time.Now()) {
+		return &Version{Version: -1}, status.Errorf(codes.NotFound, "no deleted file %s to restore", req.Filename)
+	}
+	// a file or directory may have taken the name's place since the delete
+	if err := m.checkNameClashLocked(req.Filename, nil); err != nil {
+		return &Version{Version: -1}, status.Error(codes.FailedPrecondition, status.Convert(err).Message())
+	}
+	if err := m.checkQuotaLocked(meta.Owner, NamespaceOf(req.Filename), meta.Size, meta.Size); err != nil {
+		return &Version{Version: -1}, err
+	}
+	m.UserUsage[meta.Owner] += meta.Size
+	m.NamespaceUsage[NamespaceOf(req.Filename)] += meta.Size
+
+	meta.Version++
+	meta.Deleted = false
+	meta.DeletedAt = 0
+	meta.DeletedBy = ""
+	m.recordChangeLocked(meta)
+
+	return &Version{Version: meta.Version}, nil
+}
+
+// PurgeTombstones removes the tombstones that have outlived the retention
+// and returns how many were removed
+func (m *MetaStore) PurgeTombstones(now time.Time) int {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	purged := 0
+	for fileName, meta := range m.FileMetaMap {
+		if !meta.Deleted || !m.expiredLocked(meta, now) {
+			continue
+		}
+		delete(m.FileMetaMap, fileName)
+		if meta.Seq > m.PurgedSeq {
+			m.PurgedSeq = meta.Seq
+		}
+		purged++
+	}
+	if purged > 0 {
+		fileNames := m.fileNames[:0]
+		for _, fileName := range m.fileNames {
+			if _, exists := m.FileMetaMap[fileName]; exists {
+				fileNames = append(fileNames, fileName)
+			}
+		}
+		m.fileNames = fileNames
+	}
+	// nobody reads the changes up to a purged tombstone any more
+	if m.PurgedSeq > m.TrimmedSeq {
+		m.trimChangeLogLocked(m.PurgedSeq)
+	}
+	return purged
+}
+
+// StartTombstonePurger purges expired tombstones every interval, for as
+// long as the process runs
+func (m *MetaStore) StartTombstonePurger(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			if purged := m.PurgeTombstones(now); purged > 0 {
+				log.Printf("[MetaStore] purged %d tombstones\n", purged)
+			}
+		}
+	}()
+}
+
+// RecalculateUsage tells the BlockStore which blocks the committed files of
+// every owner and namespace refer to. Blocks a client charged to the wrong
+// namespace move to the right one. Blocks no file refers to, because they
+// were never committed or their tombstones were purged, are deleted if
+// nobody uses them before the next recalculation.
+func (m *MetaStore) RecalculateUsage(ctx context.Context) error {
+	if m.BlockStoreAddr == "" {
+		return nil
+	}
+	// an attribution that is cut short must not be applied, or the blocks
+	// of the files it left out would be deleted
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	m.Mutex.Lock()
+	m.recalculations++
+	var files []*FileMetaData
+	for _, meta := range m.FileMetaMap {
+		if meta.SymlinkTarget == "" {
+			// updates replace the block list instead of changing it
+			files = append(files, &FileMetaData{Filename: meta.Filename, Owner: meta.Owner, BlockHashList: meta.BlockHashList, BlockTreeRoot: meta.BlockTreeRoot})
+		}
+	}
+	m.Mutex.Unlock()
+
+	conn, err := m.blockStoreClient()
+	if err != nil {
+		return err
+	}
+	client := NewBlockStoreClient(conn)
+	if m.BlockStoreToken != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, AUTH_METADATA_KEY, AUTH_SCHEME+m.BlockStoreToken)
+	}
+	stream, err := client.AttributeBlocks(ctx)
+	if err != nil {
+		return err
+	}
+	for _, meta := range files {
+		hashes := meta.BlockHashList
+		if meta.BlockTreeRoot != "" {
+			if hashes, err = treeBlocks(ctx, client, meta.BlockTreeRoot); err != nil {
+				if code := status.Code(err); code != codes.NotFound && code != codes.DataLoss {
+					return err
+				}
+				// one broken file must not stop the attribution of all
+				// others, the blocks its tree still reaches keep counting
+				log.Printf("[MetaStore] block tree of %s is broken: %v\n", meta.Filename, err)
+			}
+		}
+		for first := 0; first < len(hashes); first += HAS_BLOCKS_BATCH_SIZE {
+			last := first + HAS_BLOCKS_BATCH_SIZE
+			if last > len(hashes) {
+				last = len(hashes)
+			}
+			attribution := &BlockAttribution{Owner: meta.Owner, Namespace: NamespaceOf(meta.Filename), Hashes: hashes[first:last]}
+			if err := stream.Send(attribution); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+// treeBlocks returns the index blocks of a block tree and the data blocks
+// they list. A missing index block fails with NotFound and one that does not
+// parse with DataLoss, along with the blocks found so far.
+func treeBlocks(ctx context.Context, client BlockStoreClient, root string) ([]string, error) {
+	var hashes []string
+	pending := []string{root}
+	for len(pending) > 0 {
+		hash := pending[0]
+		pending = pending[1:]
+		block, err := client.GetBlock(ctx, &BlockHash{Hash: hash})
+		if err != nil {
+			return hashes, err
+		}
+		level, children, err := parseIndexBlock(block.BlockData)
+		if err != nil {
+			return hashes, status.Errorf(codes.DataLoss, "index block %s: %v", hash, err)
+		}
+		hashes = append(hashes, hash)
+		if level == 0 {
+			hashes = append(hashes, children...)
+		} else {
+			pending = append(pending, children...)
+		}
+	}
+	return hashes, nil
+}
+
+// StartUsageRecalculator recalculates the physical usage every interval,
+// for as long as the process runs
+func (m *MetaStore) StartUsageRecalculator(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := m.RecalculateUsage(context.Background()); err != nil {
+				log.Printf("[MetaStore] recalculating usage: %v\n", err)
+			}
+		}
+	}()
+}
+
+func (m *MetaStore) expiredLocked(meta *FileMetaData, now time.Time) bool {
+	return m.TombstoneRetention > 0 && now.Sub(time.Unix(0, meta.DeletedAt)) >= m.TombstoneRetention
 }
 
 func (m *MetaStore) GetBlockStoreAddr(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddr, error) {
 	return &BlockStoreAddr{Addr: m.BlockStoreAddr}, nil
 }
 
+// GetBlockSizeRange advertises the block size clients should chunk new
+// files with and the sizes UpdateFile accepts
+func (m *MetaStore) GetBlockSizeRange(ctx context.Context, _ *emptypb.Empty) (*BlockSizeRange, error) {
+	return &BlockSizeRange{DefaultSize: m.DefaultBlockSize, MinSize: m.MinBlockSize, MaxSize: m.MaxBlockSize}, nil
+}
+
+// GrantAccess gives a principal access to a file or, if no such file
+// exists, to every file under the directory prefix path
+func (m *MetaStore) GrantAccess(ctx context.Context, req *AccessRequest) (*Success, error) {
+	if req.Principal == "" || req.Permission == Permission_NONE {
+		return &Success{Flag: false}, status.Error(codes.InvalidArgument, "grant needs a principal and a permission")
+	}
+
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	user := UserFromContext(ctx)
+	if user == "" {
+		return &Success{Flag: false}, status.Error(codes.Unauthenticated, "anonymous users may not change access")
+	}
+
+	if meta, exists := m.FileMetaMap[req.Path]; exists {
+		// everyone administers a file nobody owns, so nobody may claim it
+		if !m.governedLocked(req.Path) {
+			return &Success{Flag: false}, status.Errorf(codes.PermissionDenied, "%s has no owner or admin to grant access", req.Path)
+		}
+		if m.permissionLocked(user, req.Path) < Permission_ADMIN {
+			return &Success{Flag: false}, status.Errorf(codes.PermissionDenied, "user %q may not administer %s", user, req.Path)
+		}
+		if meta.Owner == "" {
+			meta.Owner = user
+			m.UserUsage[""] -= liveSize(meta)
+			m.UserUsage[user] += liveSize(meta)
+		}
+		meta.Acl = setAclEntry(meta.Acl, req.Principal, req.Permission)
+		m.recordChangeLocked(meta)
+		return &Success{Flag: true}, nil
+	}
+
+	prefix := DirPrefix(req.Path)
+	if prefix == "" {
+		return &Success{Flag: false}, status.Error(codes.InvalidArgument, "grant needs a file or directory path")
+	}
+	if err := m.checkDirAdminLocked(user, prefix); err != nil {
+		return &Success{Flag: false}, err
+	}
+	dirAcl, exists := m.DirAclMap[prefix]
+	if !exists {
+		dirAcl = &DirectoryAcl{Owner: user}
+		m.DirAclMap[prefix] = dirAcl
+	}
+	dirAcl.Acl = setAclEntry(dirAcl.Acl, req.Principal, req.Permission)
+
+	// files newly visible to the principal have to show up in its change feed
+	for fileName, meta := range m.FileMetaMap {
+		if strings.HasPrefix(fileName, prefix) {
+			m.recordChangeLocked(meta)
+		}
+	}
+
+	return &Success{Flag: true}, nil
+}
+
+// RevokeAccess removes a principal's entry from a file or directory ACL
+func (m *MetaStore) RevokeAccess(ctx context.Context, req *AccessRequest) (*Success, error) {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	user := UserFromContext(ctx)
+	if meta, exists := m.FileMetaMap[req.Path]; exists {
+		if m.permissionLocked(user, req.Path) < Permission_ADMIN {
+			return &Success{Flag: false}, status.Errorf(codes.PermissionDenied, "user %q may not administer %s", user, req.Path)
+		}
+		meta.Acl = removeAclEntry(meta.Acl, req.Principal)
+		m.recordChangeLocked(meta)
+		return &Success{Flag: true}, nil
+	}
+
+	prefix := DirPrefix(req.Path)
+	dirAcl, exists := m.DirAclMap[prefix]
+	if !exists {
+		return &Success{Flag: false}, status.Errorf(codes.NotFound, "no file or shared directory %s", req.Path)
+	}
+	if m.permissionLocked(user, prefix) < Permission_ADMIN {
+		return &Success{Flag: false}, status.Errorf(codes.PermissionDenied, "user %q may not administer %s", user, req.Path)
+	}
+	dirAcl.Acl = removeAclEntry(dirAcl.Acl, req.Principal)
+
+	// the files stay in the change feed of those who can still read them
+	for fileName, meta := range m.FileMetaMap {
+		if strings.HasPrefix(fileName, prefix) {
+			m.recordChangeLocked(meta)
+		}
+	}
+
+	return &Success{Flag: true}, nil
+}
+
+// GetUsage reports the logical bytes stored by the caller and a namespace
+// the caller may read. The user in the request has to be empty or the
+// caller.
+func (m *MetaStore) GetUsage(ctx context.Context, req *UsageRequest) (*UsageReport, error) {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	user := UserFromContext(ctx)
+	if req.User != "" && req.User != user {
+		return nil, status.Errorf(codes.PermissionDenied, "user %q may not see the usage of %q", user, req.User)
+	}
+	if req.Namespace != "" && m.permissionLocked(user, DirPrefix(req.Namespace)) < Permission_READ {
+		return nil, status.Errorf(codes.PermissionDenied, "user %q may not read namespace %q", user, req.Namespace)
+	}
+
+	return &UsageReport{
+		User: user,
+		UserUsage: &Usage{
+			LogicalBytes: m.UserUsage[user],
+			LogicalLimit: m.Quotas.UserQuota(user).LogicalBytes,
+		},
+		Namespace: req.Namespace,
+		NamespaceUsage: &Usage{
+			LogicalBytes: m.NamespaceUsage[req.Namespace],
+			LogicalLimit: m.Quotas.NamespaceQuota(req.Namespace).LogicalBytes,
+		},
+	}, nil
+}
+
+// ListFiles returns the files the caller is allowed to read whose names
+// start with the prefix, in name order, one page at a time. A page that is
+// not the last carries a token that continues after its last file. Pages
+// are not a snapshot: to catch files that change while paging, remember
+// LatestSeq from GetChangesSince before listing and ask for the changes
+// since then afterwards.
+func (m *MetaStore) ListFiles(ctx context.Context, req *ListFilesRequest) (*ListFilesResponse, error) {
+	pageSize := req.PageSize
+	if pageSize <= 0 {
+		pageSize = DEFAULT_LIST_PAGE_SIZE
+	} else if pageSize > MAX_LIST_PAGE_SIZE {
+		pageSize = MAX_LIST_PAGE_SIZE
+	}
+	after, err := base64.RawURLEncoding.DecodeString(req.PageToken)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid page token %q", req.PageToken)
+	}
+
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	user := UserFromContext(ctx)
+	// the page starts at the first name after the token that has the prefix
+	start := req.Prefix
+	if string(after) >= start {
+		start = string(after) + "\x00"
+	}
+
+	// a page also ends early once it holds MAX_LIST_PAGE_BYTES of metadata
+	page := &ListFilesResponse{}
+	pageBytes := 0
+	for i := sort.SearchStrings(m.fileNames, start); i < len(m.fileNames) && strings.HasPrefix(m.fileNames[i], req.Prefix); i++ {
+		fileName := m.fileNames[i]
+		if len(page.Files) == int(pageSize) || pageBytes >= MAX_LIST_PAGE_BYTES {
+			page.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(page.Files[len(page.Files)-1].Filename))
+			break
+		}
+		if m.permissionLocked(user, fileName) >= Permission_READ {
+			page.Files = append(page.Files, proto.Clone(m.FileMetaMap[fileName]).(*FileMetaData))
+			pageBytes += proto.Size(m.FileMetaMap[fileName])
+		}
+	}
+	return page, nil
+}
+
+// GetChangesSince returns the readable files changed after a sequence number.
+// When the caller's epoch is stale, it has no sequence number yet or more
+// files changed than fit in a ListFiles page, the whole FileInfoMap is
+// returned and marked full.
+func (m *MetaStore) GetChangesSince(ctx context.Context, req *ChangeRequest) (*ChangeList, error) {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	return m.changesSinceLocked(UserFromContext(ctx), req.Epoch, req.SinceSeq, req.OmitFullListing), nil
+}
+
+// WatchFiles streams the changes after the requested sequence number, then
+// pushes every later change as it commits. A client resumes after a
+// reconnect by sending the epoch and last sequence number it received.
+func (m *MetaStore) WatchFiles(req *ChangeRequest, stream MetaStore_WatchFilesServer) error {
+	user := UserFromContext(stream.Context())
+	epoch, seq := req.Epoch, req.SinceSeq
+
+	for {
+		m.Mutex.Lock()
+		changes := m.changesSinceLocked(user, epoch, seq, req.OmitFullListing)
+		changed := m.changed
+		m.Mutex.Unlock()
+
+		if changes.Full || len(changes.Files) > 0 {
+			if err := stream.Send(changes); err != nil {
+				return err
+			}
+		}
+		epoch, seq = changes.Epoch, changes.LatestSeq
+
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func (m *MetaStore) changesSinceLocked(user string, epoch string, since int64, omitFullListing bool) *ChangeList {
+	if epoch != m.Epoch || since <= 0 || since > m.Seq || since < m.PurgedSeq || since < m.TrimmedSeq {
+		return m.fullChangesLocked(user, omitFullListing)
+	}
+
+	// more changes than a ListFiles page holds are sent as a full listing,
+	// which the client pages through
+	changes := &ChangeList{Epoch: m.Epoch, LatestSeq: m.Seq}
+	changesBytes := 0
+	seen := make(map[string]bool)
+	for _, fileName := range m.ChangeLog[since-m.TrimmedSeq:] {
+		if seen[fileName] {
+			continue
+		}
+		seen[fileName] = true
+		meta, exists := m.FileMetaMap[fileName]
+		if !exists || m.permissionLocked(user, fileName) < Permission_READ {
+			continue
+		}
+		if len(changes.Files) == int(MAX_LIST_PAGE_SIZE) || changesBytes >= MAX_LIST_PAGE_BYTES {
+			return m.fullChangesLocked(user, omitFullListing)
+		}
+		changes.Files = append(changes.Files, proto.Clone(meta).(*FileMetaData))
+		changesBytes += proto.Size(meta)
+	}
+	return changes
+}
+
+// fullChangesLocked returns the whole FileInfoMap the user can read,
+// marked full
+func (m *MetaStore) fullChangesLocked(user string, omitFullListing bool) *ChangeList {
+	changes := &ChangeList{Epoch: m.Epoch, LatestSeq: m.Seq, Full: true}
+	if omitFullListing {
+		return changes
+	}
+	for fileName, meta := range m.FileMetaMap {
+		if m.permissionLocked(user, fileName) >= Permission_READ {
+			changes.Files = append(changes.Files, proto.Clone(meta).(*FileMetaData))
+		}
+	}
+	return changes
+}
+
+// putFileLocked stores meta under its file name, adding a new name to the
+// sorted index
+func (m *MetaStore) putFileLocked(meta *FileMetaData) {
+	if _, exists := m.FileMetaMap[meta.Filename]; !exists {
+		i := sort.SearchStrings(m.fileNames, meta.Filename)
+		m.fileNames = append(m.fileNames, "")
+		copy(m.fileNames[i+1:], m.fileNames[i:])
+		m.fileNames[i] = meta.Filename
+	}
+	m.FileMetaMap[meta.Filename] = meta
+}
+
+// recordChangeLocked gives a changed file the next sequence number
+// and wakes up the watchers
+func (m *MetaStore) recordChangeLocked(meta *FileMetaData) {
+	m.Seq++
+	meta.Seq = m.Seq
+	m.ChangeLog = append(m.ChangeLog, meta.Filename)
+	if len(m.ChangeLog) > MAX_CHANGE_LOG_LENGTH {
+		m.trimChangeLogLocked(m.Seq - int64(MAX_CHANGE_LOG_LENGTH/2))
+	}
+
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// trimChangeLogLocked drops the changes up to and including seq
+func (m *MetaStore) trimChangeLogLocked(seq int64) {
+	if seq > m.Seq {
+		seq = m.Seq
+	}
+	m.ChangeLog = append([]string(nil), m.ChangeLog[seq-m.TrimmedSeq:]...)
+	m.TrimmedSeq = seq
+}
+
+// lockWithBlocks checks that the BlockStore has every block of hashes and
+// returns with m.Mutex held, so the caller can commit files referring to
+// them. The check runs without the lock. The BlockStore only deletes a
+// block that two recalculations in a row found unused, and HasBlocks spares
+// it from the first, so a block can only go missing before the commit if a
+// recalculation took its snapshot during the check. Then it checks again.
+func (m *MetaStore) lockWithBlocks(ctx context.Context, hashes []string) error {
+	for {
+		m.Mutex.Lock()
+		recalculations := m.recalculations
+		m.Mutex.Unlock()
+
+		if err := m.checkBlocksExist(ctx, hashes); err != nil {
+			return err
+		}
+
+		m.Mutex.Lock()
+		if m.recalculations == recalculations {
+			return nil
+		}
+		m.Mutex.Unlock()
+	}
+}
+
+// checkBlocksExist asks the BlockStore whether it has every block a file
+// refers to, HAS_BLOCKS_BATCH_SIZE hashes at a time. Missing blocks fail
+// with FailedPrecondition, with the missing hashes attached as a
+// BlockHashes detail.
+func (m *MetaStore) checkBlocksExist(ctx context.Context, hashes []string) error {
+	if len(hashes) == 0 || m.BlockStoreAddr == "" {
+		return nil
+	}
+	conn, err := m.blockStoreClient()
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "connecting to BlockStore: %v", err)
+	}
+
+	unique := make([]string, 0, len(hashes))
+	seen := make(map[string]bool)
+	for _, hash := range hashes {
+		if !seen[hash] {
+			seen[hash] = true
+			unique = append(unique, hash)
+		}
+	}
+	client := NewBlockStoreClient(conn)
+	stored := make(map[string]bool)
+	for first := 0; first < len(unique); first += HAS_BLOCKS_BATCH_SIZE {
+		last := first + HAS_BLOCKS_BATCH_SIZE
+		if last > len(unique) {
+			last = len(unique)
+		}
+		present, err := client.HasBlocks(ctx, &BlockHashes{Hashes: unique[first:last]})
+		if err != nil {
+			return status.Errorf(codes.Unavailable, "checking blocks on BlockStore: %v", err)
+		}
+		for _, hash := range present.Hashes {
+			stored[hash] = true
+		}
+	}
+	missing := &BlockHashes{}
+	for _, hash := range unique {
+		if !stored[hash] {
+			missing.Hashes = append(missing.Hashes, hash)
+		}
+	}
+	if len(missing.Hashes) == 0 {
+		return nil
+	}
+
+	st := status.Newf(codes.FailedPrecondition, "%d blocks are missing on the BlockStore", len(missing.Hashes))
+	if detailed, err := st.WithDetails(missing); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// blockStoreClient returns the connection to the BlockStore, dialing it on
+// first use
+func (m *MetaStore) blockStoreClient() (*grpc.ClientConn, error) {
+	m.blockStoreMu.Lock()
+	defer m.blockStoreMu.Unlock()
+
+	if m.blockStoreConn == nil {
+		conn, err := grpc.Dial(m.BlockStoreAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return nil, err
+		}
+		m.blockStoreConn = conn
+	}
+	return m.blockStoreConn, nil
+}
+
+// markDeleted turns a file into a tombstone deleted by user now
+func markDeleted(meta *FileMetaData, user string) {
+	meta.Deleted = true
+	meta.DeletedAt = time.Now().UnixNano()
+	meta.DeletedBy = user
+}
+
+// liveSize is the logical size a file counts towards quotas, tombstones
+// keep their size for undelete but do not count
+func liveSize(meta *FileMetaData) int64 {
+	if meta.Deleted {
+		return 0
+	}
+	return meta.Size
+}
+
+// checkQuotaLocked rejects growing the logical bytes of owner and namespace
+// past their quota
+func (m *MetaStore) checkQuotaLocked(owner string, namespace string, userDelta int64, namespaceDelta int64) error {
+	if limit := m.Quotas.UserQuota(owner).LogicalBytes; exceeds(m.UserUsage[owner], userDelta, limit) {
+		return status.Errorf(codes.ResourceExhausted, "user %q would exceed its quota of %d bytes", owner, limit)
+	}
+	if limit := m.Quotas.NamespaceQuota(namespace).LogicalBytes; exceeds(m.NamespaceUsage[namespace], namespaceDelta, limit) {
+		return status.Errorf(codes.ResourceExhausted, "namespace %q would exceed its quota of %d bytes", namespace, limit)
+	}
+	return nil
+}
+
+// permissionLocked computes what user may do with a file or directory prefix.
+// Paths that no owner or ACL governs stay open to everyone.
+func (m *MetaStore) permissionLocked(user string, path string) Permission {
+	if !m.governedLocked(path) {
+		return Permission_ADMIN
+	}
+	perm := Permission_NONE
+
+	if meta, exists := m.FileMetaMap[path]; exists {
+		perm = aclPermission(user, meta.Owner, meta.Acl)
+	}
+	for i := 0; i < len(path); i++ {
+		if path[i] != '/' {
+			continue
+		}
+		dirAcl, exists := m.DirAclMap[path[:i+1]]
+		if !exists {
+			continue
+		}
+		if p := aclPermission(user, dirAcl.Owner, dirAcl.Acl); p > perm {
+			perm = p
+		}
+	}
+	return perm
+}
+
+// governedLocked reports whether an owner or an ACL entry of the file or
+// of a directory above it decides who may access path
+func (m *MetaStore) governedLocked(path string) bool {
+	if meta, exists := m.FileMetaMap[path]; exists && (meta.Owner != "" || len(meta.Acl) > 0) {
+		return true
+	}
+	for i := 0; i < len(path); i++ {
+		if path[i] != '/' {
+			continue
+		}
+		if _, exists := m.DirAclMap[path[:i+1]]; exists {
+			return true
+		}
+	}
+	return false
+}
+
+// PermissionOf is permissionLocked for a BlockStore in the same process
+func (m *MetaStore) PermissionOf(user string, path string) Permission {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	return m.permissionLocked(user, path)
+}
+
+// checkDirAdminLocked verifies user administers a directory prefix. Sharing a
+// directory for the first time also requires administering every file in it,
+// and none of the live ones may be without an owner.
+func (m *MetaStore) checkDirAdminLocked(user string, prefix string) error {
+	if m.permissionLocked(user, prefix) < Permission_ADMIN {
+		return status.Errorf(codes.PermissionDenied, "user %q may not administer %s", user, prefix)
+	}
+	if _, exists := m.DirAclMap[prefix]; exists {
+		return nil
+	}
+	for fileName, meta := range m.FileMetaMap {
+		if !strings.HasPrefix(fileName, prefix) {
+			continue
+		}
+		if !isTombstone(meta) && !m.governedLocked(fileName) {
+			return status.Errorf(codes.PermissionDenied, "%s has no owner or admin to grant access", fileName)
+		}
+		if m.permissionLocked(user, fileName) < Permission_ADMIN {
+			return status.Errorf(codes.PermissionDenied, "user %q may not administer %s", user, fileName)
+		}
+	}
+	return nil
+}
+
 // This line guarantees all method for MetaStore are implemented
 var _ MetaStoreInterface = new(MetaStore)
 
 func NewMetaStore(blockStoreAddr string) *MetaStore {
 	return &MetaStore{
-		FileMetaMap:    map[string]*FileMetaData{},
-		BlockStoreAddr: blockStoreAddr,
-		Mutex:          sync.Mutex{},
+		FileMetaMap:      map[string]*FileMetaData{},
+		DirAclMap:        map[string]*DirectoryAcl{},
+		UserUsage:        map[string]int64{},
+		NamespaceUsage:   map[string]int64{},
+		BlockStoreAddr:   blockStoreAddr,
+		DefaultBlockSize: DEFAULT_BLOCK_SIZE,
+		MinBlockSize:     MIN_BLOCK_SIZE,
+		MaxBlockSize:     MAX_BLOCK_SIZE,
+		Epoch:            strconv.FormatInt(time.Now().UnixNano(), 36),
+		changed:          make(chan struct{}),
+		Mutex:            sync.Mutex{},
 	}
 }
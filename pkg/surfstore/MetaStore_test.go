@@ -0,0 +1,455 @@
+package surfstore
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestUpdateFileVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		stored  *FileMetaData
+		version int32
+		deleted bool
+		want    codes.Code
+	}{
+		{"new file starts at 1", nil, 1, false, codes.OK},
+		{"new file ahead of 1", nil, 2, false, codes.FailedPrecondition},
+		{"next version", &FileMetaData{Version: 3}, 4, false, codes.OK},
+		{"same version", &FileMetaData{Version: 3}, 3, false, codes.FailedPrecondition},
+		{"stale version", &FileMetaData{Version: 3}, 2, false, codes.FailedPrecondition},
+		{"skipped version", &FileMetaData{Version: 3}, 5, false, codes.FailedPrecondition},
+		{"after a tombstone", &FileMetaData{Version: 3, Deleted: true}, 4, false, codes.OK},
+		{"recreated over an unseen tombstone", &FileMetaData{Version: 3, Deleted: true}, 1, false, codes.OK},
+		{"version 1 over a live file", &FileMetaData{Version: 3}, 1, false, codes.FailedPrecondition},
+		{"delete the next version", &FileMetaData{Version: 3}, 4, true, codes.OK},
+		{"delete a stale version", &FileMetaData{Version: 3}, 3, true, codes.FailedPrecondition},
+		{"tombstone at 1 over a tombstone", &FileMetaData{Version: 3, Deleted: true}, 1, true, codes.FailedPrecondition},
+	}
+	for _, tt := range tests {
+		m := NewMetaStore("")
+		if tt.stored != nil {
+			tt.stored.Filename = "a"
+			m.putFileLocked(tt.stored)
+		}
+		update := &FileMetaData{Filename: "a", Version: tt.version, Deleted: tt.deleted}
+		if !tt.deleted {
+			update.BlockHashList = []string{"h"}
+		}
+		_, err := m.UpdateFile(context.Background(), update)
+		if got := status.Code(err); got != tt.want {
+			t.Errorf("%s: UpdateFile version %d = %v, want %v", tt.name, tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateFileTwoWriters(t *testing.T) {
+	ctx := context.Background()
+	m := NewMetaStore("")
+	if _, err := m.UpdateFile(ctx, &FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{"v1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// both writers edited version 1
+	if _, err := m.UpdateFile(ctx, &FileMetaData{Filename: "a", Version: 2, BlockHashList: []string{"A"}}); err != nil {
+		t.Fatalf("first writer: %v", err)
+	}
+	_, err := m.UpdateFile(ctx, &FileMetaData{Filename: "a", Version: 2, BlockHashList: []string{"B"}})
+	if status.Code(err) != codes.FailedPrecondition || MissingBlocks(err) != nil {
+		t.Fatalf("second writer: got %v, want a version FailedPrecondition", err)
+	}
+	if meta := m.FileMetaMap["a"]; meta.Version != 2 || meta.BlockHashList[0] != "A" {
+		t.Errorf("stored version %d with %v, want the first writer's version 2", meta.Version, meta.BlockHashList)
+	}
+}
+
+func TestUpdateFilesTwoWriters(t *testing.T) {
+	ctx := context.Background()
+	m := NewMetaStore("")
+	for _, fileName := range []string{"a", "b"} {
+		if _, err := m.UpdateFile(ctx, &FileMetaData{Filename: fileName, Version: 1, BlockHashList: []string{"v1"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.UpdateFile(ctx, &FileMetaData{Filename: "b", Version: 2, BlockHashList: []string{"A"}}); err != nil {
+		t.Fatalf("first writer: %v", err)
+	}
+
+	// the second writer's batch is based on version 1 of both files
+	batch := &FileInfoMap{FileInfoMap: map[string]*FileMetaData{
+		"a": {Filename: "a", Version: 2, BlockHashList: []string{"B"}},
+		"b": {Filename: "b", Version: 2, BlockHashList: []string{"B"}},
+	}}
+	if _, err := m.UpdateFiles(ctx, batch); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("second writer: got %v, want FailedPrecondition", err)
+	}
+	if meta := m.FileMetaMap["a"]; meta.Version != 1 {
+		t.Errorf("a has version %d, want the rejected batch to leave it at 1", meta.Version)
+	}
+	if meta := m.FileMetaMap["b"]; meta.Version != 2 || meta.BlockHashList[0] != "A" {
+		t.Errorf("b has version %d with %v, want the first writer's version 2", meta.Version, meta.BlockHashList)
+	}
+}
+
+func TestRenameFileVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		fromVersion int32
+		want        codes.Code
+	}{
+		{"current version", 3, codes.OK},
+		{"stale version", 2, codes.FailedPrecondition},
+		{"version ahead", 4, codes.FailedPrecondition},
+	}
+	for _, tt := range tests {
+		m := NewMetaStore("")
+		m.putFileLocked(&FileMetaData{Filename: "a", Version: 3, BlockHashList: []string{"h"}})
+		_, err := m.RenameFile(context.Background(), &RenameRequest{From: "a", FromVersion: tt.fromVersion, To: &FileMetaData{Filename: "b", BlockHashList: []string{"h"}}})
+		if got := status.Code(err); got != tt.want {
+			t.Errorf("%s: RenameFile from version %d = %v, want %v", tt.name, tt.fromVersion, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateFileChecksBlocksInBatches(t *testing.T) {
+	var largest int
+	_, m, bs := startTestServer(t, grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if hashes, ok := req.(*BlockHashes); ok && len(hashes.Hashes) > largest {
+			largest = len(hashes.Hashes)
+		}
+		return handler(ctx, req)
+	}))
+
+	var hashes []string
+	for i := 0; i <= HAS_BLOCKS_BATCH_SIZE; i++ {
+		data := []byte(strconv.Itoa(i))
+		hash := GetBlockHashString(data)
+		bs.BlockMap[hash] = &Block{BlockData: data, BlockSize: int32(len(data))}
+		hashes = append(hashes, hash)
+	}
+	missing := GetBlockHashString([]byte("missing"))
+
+	tests := []struct {
+		name    string
+		hashes  []string
+		want    codes.Code
+		missing []string
+	}{
+		{"all stored", hashes, codes.OK, nil},
+		{"one missing in the last batch", append(append([]string(nil), hashes...), missing), codes.FailedPrecondition, []string{missing}},
+	}
+	for _, tt := range tests {
+		largest = 0
+		_, err := m.UpdateFile(context.Background(), &FileMetaData{Filename: tt.name, Version: 1, BlockHashList: tt.hashes})
+		if got := status.Code(err); got != tt.want {
+			t.Errorf("%s: UpdateFile = %v, want %v", tt.name, err, tt.want)
+		}
+		if got := MissingBlocks(err); !reflect.DeepEqual(got, tt.missing) {
+			t.Errorf("%s: missing blocks %v, want %v", tt.name, got, tt.missing)
+		}
+		if largest > HAS_BLOCKS_BATCH_SIZE {
+			t.Errorf("%s: HasBlocks was asked about %d hashes at once, want at most %d", tt.name, largest, HAS_BLOCKS_BATCH_SIZE)
+		}
+	}
+}
+
+func TestUpdateFileNameClash(t *testing.T) {
+	tests := []struct {
+		name     string
+		stored   *FileMetaData
+		fileName string
+		deleted  bool
+		want     codes.Code
+	}{
+		{"file inside a file", &FileMetaData{Filename: "a", Version: 1}, "a/b", false, codes.InvalidArgument},
+		{"file deep inside a file", &FileMetaData{Filename: "a", Version: 1}, "a/b/c", false, codes.InvalidArgument},
+		{"file named like a directory", &FileMetaData{Filename: "a/b/c", Version: 1}, "a", false, codes.InvalidArgument},
+		{"file inside a deleted file", &FileMetaData{Filename: "a", Version: 1, Deleted: true}, "a/b", false, codes.OK},
+		{"file named like a deleted directory", &FileMetaData{Filename: "a/b", Version: 1, Deleted: true}, "a", false, codes.OK},
+		{"sibling sharing a prefix", &FileMetaData{Filename: "ab/c", Version: 1}, "a", false, codes.OK},
+		{"tombstone inside a file", &FileMetaData{Filename: "a", Version: 1}, "a/b", true, codes.OK},
+	}
+	for _, tt := range tests {
+		m := NewMetaStore("")
+		m.putFileLocked(tt.stored)
+		_, err := m.UpdateFile(context.Background(), &FileMetaData{Filename: tt.fileName, Version: 1, Deleted: tt.deleted})
+		if got := status.Code(err); got != tt.want {
+			t.Errorf("%s: UpdateFile %s = %v, want %v", tt.name, tt.fileName, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateFilesNameClash(t *testing.T) {
+	tests := []struct {
+		name  string
+		batch []*FileMetaData
+		want  codes.Code
+	}{
+		{"file and directory", []*FileMetaData{{Filename: "x", Version: 1}, {Filename: "x/y", Version: 1}}, codes.InvalidArgument},
+		{"file replaced by a directory", []*FileMetaData{{Filename: "a", Version: 2, Deleted: true}, {Filename: "a/b", Version: 1}}, codes.OK},
+	}
+	for _, tt := range tests {
+		m := NewMetaStore("")
+		m.putFileLocked(&FileMetaData{Filename: "a", Version: 1})
+		batch := &FileInfoMap{FileInfoMap: map[string]*FileMetaData{}}
+		for _, meta := range tt.batch {
+			batch.FileInfoMap[meta.Filename] = meta
+		}
+		_, err := m.UpdateFiles(context.Background(), batch)
+		if got := status.Code(err); got != tt.want {
+			t.Errorf("%s: UpdateFiles = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGrantAccessNeedsOwner(t *testing.T) {
+	tests := []struct {
+		name   string
+		stored *FileMetaData
+		dirAcl *DirectoryAcl
+		user   string
+		path   string
+		want   codes.Code
+	}{
+		{"owner", &FileMetaData{Owner: "alice"}, nil, "alice", "team/f", codes.OK},
+		{"stranger", &FileMetaData{Owner: "alice"}, nil, "carol", "team/f", codes.PermissionDenied},
+		{"admin entry", &FileMetaData{Acl: []*AccessControlEntry{{Principal: "bob", Permission: Permission_ADMIN}}}, nil, "bob", "team/f", codes.OK},
+		{"unowned file", &FileMetaData{}, nil, "carol", "team/f", codes.PermissionDenied},
+		{"unowned file in a shared directory", &FileMetaData{}, &DirectoryAcl{Owner: "alice"}, "alice", "team/f", codes.OK},
+		{"anonymous", &FileMetaData{}, nil, "", "team/f", codes.Unauthenticated},
+		{"directory of an unowned file", &FileMetaData{}, nil, "carol", "team", codes.PermissionDenied},
+		{"directory of an owned file", &FileMetaData{Owner: "alice"}, nil, "alice", "team", codes.OK},
+		{"directory of an unowned tombstone", &FileMetaData{Deleted: true}, nil, "carol", "team", codes.OK},
+	}
+	for _, tt := range tests {
+		m := NewMetaStore("")
+		tt.stored.Filename, tt.stored.Version = "team/f", 1
+		m.putFileLocked(tt.stored)
+		if tt.dirAcl != nil {
+			m.DirAclMap["team/"] = tt.dirAcl
+		}
+		_, err := m.GrantAccess(userContext(tt.user), &AccessRequest{Path: tt.path, Principal: tt.user + "-friend", Permission: Permission_ADMIN})
+		if got := status.Code(err); got != tt.want {
+			t.Errorf("%s: GrantAccess = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestUndeleteFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		stored    []*FileMetaData
+		retention time.Duration
+		want      codes.Code
+	}{
+		{"tombstone", []*FileMetaData{{Filename: "a", Version: 2, Deleted: true, DeletedAt: time.Now().UnixNano()}}, time.Hour, codes.OK},
+		{"kept forever", []*FileMetaData{{Filename: "a", Version: 2, Deleted: true, DeletedAt: 1}}, 0, codes.OK},
+		{"expired tombstone", []*FileMetaData{{Filename: "a", Version: 2, Deleted: true, DeletedAt: 1}}, time.Hour, codes.NotFound},
+		{"live file", []*FileMetaData{{Filename: "a", Version: 2, BlockHashList: []string{"h"}}}, time.Hour, codes.NotFound},
+		{"missing file", nil, time.Hour, codes.NotFound},
+		{
+			"directory took the name",
+			[]*FileMetaData{{Filename: "a", Version: 2, Deleted: true, DeletedAt: time.Now().UnixNano()}, {Filename: "a/b", Version: 1, BlockHashList: []string{"h"}}},
+			time.Hour, codes.FailedPrecondition,
+		},
+		{
+			"file took the directory",
+			[]*FileMetaData{{Filename: "a/b", Version: 2, Deleted: true, DeletedAt: time.Now().UnixNano()}, {Filename: "a", Version: 1, BlockHashList: []string{"h"}}},
+			time.Hour, codes.FailedPrecondition,
+		},
+	}
+	for _, tt := range tests {
+		m := NewMetaStore("")
+		m.TombstoneRetention = tt.retention
+		for _, meta := range tt.stored {
+			m.putFileLocked(meta)
+		}
+		fileName := "a"
+		if len(tt.stored) > 0 {
+			fileName = tt.stored[0].Filename
+		}
+		version, err := m.UndeleteFile(context.Background(), &UndeleteRequest{Filename: fileName})
+		if got := status.Code(err); got != tt.want {
+			t.Errorf("%s: UndeleteFile = %v, want %v", tt.name, err, tt.want)
+			continue
+		}
+		if tt.want == codes.OK {
+			if meta := m.FileMetaMap[fileName]; meta.Deleted || meta.Version != 3 || version.Version != 3 {
+				t.Errorf("%s: restored %s is deleted %v at version %d, want live at version 3", tt.name, fileName, meta.Deleted, meta.Version)
+			}
+		} else if meta, ok := m.FileMetaMap[fileName]; ok && len(tt.stored) > 0 && !proto.Equal(meta, tt.stored[0]) {
+			t.Errorf("%s: %s changed to %v", tt.name, fileName, meta)
+		}
+	}
+}
+
+func TestPurgeTombstones(t *testing.T) {
+	now := time.Now()
+	m := NewMetaStore("")
+	m.TombstoneRetention = time.Hour
+	for _, meta := range []*FileMetaData{
+		{Filename: "old", Version: 2, Deleted: true, DeletedAt: now.Add(-2 * time.Hour).UnixNano()},
+		{Filename: "recent", Version: 2, Deleted: true, DeletedAt: now.Add(-time.Minute).UnixNano()},
+		{Filename: "live", Version: 1, BlockHashList: []string{"h"}},
+	} {
+		m.putFileLocked(meta)
+		m.recordChangeLocked(meta)
+	}
+	oldSeq := m.FileMetaMap["old"].Seq
+
+	if purged := m.PurgeTombstones(now); purged != 1 {
+		t.Errorf("PurgeTombstones = %d, want 1", purged)
+	}
+	if _, ok := m.FileMetaMap["old"]; ok {
+		t.Error("the expired tombstone was kept")
+	}
+	for _, fileName := range []string{"recent", "live"} {
+		if _, ok := m.FileMetaMap[fileName]; !ok {
+			t.Errorf("%s was purged", fileName)
+		}
+	}
+	if m.PurgedSeq != oldSeq {
+		t.Errorf("PurgedSeq = %d, want the purged tombstone's %d", m.PurgedSeq, oldSeq)
+	}
+	if got := listAll(t, m, "", "", 0); !reflect.DeepEqual(got, [][]string{{"live", "recent"}}) {
+		t.Errorf("ListFiles after the purge = %v", got)
+	}
+}
+
+// listAll pages through ListFiles and returns the names of every page
+func listAll(t *testing.T, m *MetaStore, user string, prefix string, pageSize int32) [][]string {
+	var pages [][]string
+	pageToken := ""
+	for {
+		page, err := m.ListFiles(userContext(user), &ListFilesRequest{Prefix: prefix, PageSize: pageSize, PageToken: pageToken})
+		if err != nil {
+			t.Fatalf("ListFiles %q after %q: %v", prefix, pageToken, err)
+		}
+		var names []string
+		for _, meta := range page.Files {
+			names = append(names, meta.Filename)
+		}
+		pages = append(pages, names)
+		if page.NextPageToken == "" {
+			return pages
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func TestListFilesPages(t *testing.T) {
+	m := NewMetaStore("")
+	for _, fileName := range []string{"a", "b/1", "b/2", "b/3", "c"} {
+		m.putFileLocked(&FileMetaData{Filename: fileName, Version: 1})
+	}
+	m.putFileLocked(&FileMetaData{Filename: "b/private", Version: 1, Owner: "bob"})
+
+	tests := []struct {
+		name     string
+		prefix   string
+		pageSize int32
+		want     [][]string
+	}{
+		{"one page", "", 0, [][]string{{"a", "b/1", "b/2", "b/3", "c"}}},
+		{"pages of two", "", 2, [][]string{{"a", "b/1"}, {"b/2", "b/3"}, {"c"}}},
+		{"prefix", "b/", 2, [][]string{{"b/1", "b/2"}, {"b/3"}}},
+		{"no match", "d", 2, [][]string{nil}},
+	}
+	for _, tt := range tests {
+		if got := listAll(t, m, "alice", tt.prefix, tt.pageSize); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: pages %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := m.ListFiles(context.Background(), &ListFilesRequest{PageToken: "not base64!"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListFiles with a bad page token = %v, want InvalidArgument", err)
+	}
+}
+
+func TestListFilesPageBytes(t *testing.T) {
+	m := NewMetaStore("")
+	// each file has more than half of MAX_LIST_PAGE_BYTES of metadata
+	hashes := make([]string, MAX_LIST_PAGE_BYTES/2/64+1)
+	for i := range hashes {
+		hashes[i] = GetBlockHashString([]byte(strconv.Itoa(i)))
+	}
+	for _, fileName := range []string{"a", "b", "c"} {
+		m.putFileLocked(&FileMetaData{Filename: fileName, Version: 1, BlockHashList: hashes})
+	}
+
+	want := [][]string{{"a", "b"}, {"c"}}
+	if got := listAll(t, m, "", "", MAX_LIST_PAGE_SIZE); !reflect.DeepEqual(got, want) {
+		t.Errorf("pages %v, want %v", got, want)
+	}
+}
+
+func TestWatchFilesAfterTrim(t *testing.T) {
+	addr, m, _ := startTestServer(t)
+	for _, fileName := range []string{"a", "b", "c", "d", "e"} {
+		if _, err := m.UpdateFile(context.Background(), &FileMetaData{Filename: fileName, Version: 1, Deleted: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Mutex.Lock()
+	m.trimChangeLogLocked(3)
+	m.Mutex.Unlock()
+
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := NewMetaStoreClient(conn)
+
+	tests := []struct {
+		name      string
+		epoch     string
+		since     int64
+		wantFull  bool
+		wantFiles []string
+	}{
+		{"after the trimmed changes", m.Epoch, 3, false, []string{"d", "e"}},
+		{"the latest change", m.Epoch, 4, false, []string{"e"}},
+		{"behind the trimmed changes", m.Epoch, 2, true, nil},
+		{"another epoch", "other", 4, true, nil},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithCancel(context.Background())
+		stream, err := client.WatchFiles(ctx, &ChangeRequest{Epoch: tt.epoch, SinceSeq: tt.since, OmitFullListing: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		changes, err := stream.Recv()
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var files []string
+		for _, meta := range changes.Files {
+			files = append(files, meta.Filename)
+		}
+		if changes.Full != tt.wantFull || !reflect.DeepEqual(files, tt.wantFiles) || changes.LatestSeq != 5 {
+			t.Errorf("%s: got full %v with %v up to %d, want full %v with %v up to 5", tt.name, changes.Full, files, changes.LatestSeq, tt.wantFull, tt.wantFiles)
+		}
+	}
+}
+
+func TestChangeLogTrimsItself(t *testing.T) {
+	m := NewMetaStore("")
+	meta := &FileMetaData{Filename: "a", Version: 1}
+	m.putFileLocked(meta)
+	for i := 0; i <= MAX_CHANGE_LOG_LENGTH; i++ {
+		m.recordChangeLocked(meta)
+	}
+	if len(m.ChangeLog) != MAX_CHANGE_LOG_LENGTH/2 || m.TrimmedSeq != m.Seq-int64(MAX_CHANGE_LOG_LENGTH/2) {
+		t.Errorf("after %d changes the log has %d entries after %d, want the latest %d", m.Seq, len(m.ChangeLog), m.TrimmedSeq, MAX_CHANGE_LOG_LENGTH/2)
+	}
+}
@@ -0,0 +1,71 @@
+package surfstore
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// Quota limits the bytes a user or namespace may store. A zero limit
+// means unlimited.
+type Quota struct {
+	LogicalBytes  int64 `json:"logicalBytes"`
+	PhysicalBytes int64 `json:"physicalBytes"`
+}
+
+// QuotaConfig holds the quotas enforced by the MetaStore (logical bytes)
+// and the BlockStore (physical bytes). Users and namespaces without an
+// explicit entry fall back to the defaults.
+type QuotaConfig struct {
+	DefaultUser      Quota            `json:"defaultUser"`
+	DefaultNamespace Quota            `json:"defaultNamespace"`
+	Users            map[string]Quota `json:"users"`
+	Namespaces       map[string]Quota `json:"namespaces"`
+}
+
+// LoadQuotaConfig reads a JSON quota configuration file
+func LoadQuotaConfig(path string) (*QuotaConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &QuotaConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (q *QuotaConfig) UserQuota(user string) Quota {
+	if q == nil {
+		return Quota{}
+	}
+	if quota, ok := q.Users[user]; ok {
+		return quota
+	}
+	return q.DefaultUser
+}
+
+func (q *QuotaConfig) NamespaceQuota(namespace string) Quota {
+	if q == nil {
+		return Quota{}
+	}
+	if quota, ok := q.Namespaces[namespace]; ok {
+		return quota
+	}
+	return q.DefaultNamespace
+}
+
+// NamespaceOf returns the namespace of a file, which is its top-level
+// directory. Files in the base directory belong to the "" namespace.
+func NamespaceOf(filename string) string {
+	if i := strings.Index(filename, "/"); i >= 0 {
+		return filename[:i]
+	}
+	return ""
+}
+
+// exceeds reports whether growing usage by delta goes over limit
+func exceeds(usage int64, delta int64, limit int64) bool {
+	return limit > 0 && delta > 0 && usage+delta > limit
+}
@@ -0,0 +1,332 @@
+package surfstore
+
+import (
+	context "context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// RateWindow applies Rate between two times of day, in minutes after
+// midnight. A window whose end is before its start wraps past midnight.
+type RateWindow struct {
+	Start int
+	End   int
+	Rate  int64
+}
+
+// RateSchedule is a bandwidth limit in bytes per second. The first window
+// covering the local time of day wins, otherwise Rate applies. A zero rate
+// means unlimited.
+type RateSchedule struct {
+	Rate    int64
+	Windows []RateWindow
+}
+
+// ParseRateSchedule parses RATE[,HH:MM-HH:MM=RATE...], where a rate is a
+// number of bytes per second with an optional K, M or G suffix, e.g.
+// "10M,09:00-18:00=1M" limits to 1 MiB/s during office hours and to
+// 10 MiB/s otherwise. An empty string means unlimited.
+func ParseRateSchedule(spec string) (*RateSchedule, error) {
+	schedule := &RateSchedule{}
+	if spec == "" {
+		return schedule, nil
+	}
+
+	parts := strings.Split(spec, ",")
+	rate, err := parseRate(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	schedule.Rate = rate
+
+	for _, part := range parts[1:] {
+		eq := strings.Index(part, "=")
+		dash := strings.Index(part, "-")
+		if eq < 0 || dash < 0 || dash > eq {
+			return nil, fmt.Errorf("invalid rate window %q, want HH:MM-HH:MM=RATE", part)
+		}
+		window := RateWindow{}
+		if window.Start, err = parseTimeOfDay(part[:dash]); err != nil {
+			return nil, err
+		}
+		if window.End, err = parseTimeOfDay(part[dash+1 : eq]); err != nil {
+			return nil, err
+		}
+		if window.Rate, err = parseRate(part[eq+1:]); err != nil {
+			return nil, err
+		}
+		schedule.Windows = append(schedule.Windows, window)
+	}
+	return schedule, nil
+}
+
+// RateAt returns the limit in effect at t
+func (s *RateSchedule) RateAt(t time.Time) int64 {
+	if s == nil {
+		return 0
+	}
+	minute := t.Hour()*60 + t.Minute()
+	for _, window := range s.Windows {
+		inside := minute >= window.Start && minute < window.End
+		if window.End < window.Start {
+			inside = minute >= window.Start || minute < window.End
+		}
+		if inside {
+			return window.Rate
+		}
+	}
+	return s.Rate
+}
+
+func parseRate(s string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	}
+	digits := s
+	if multiplier > 1 {
+		digits = s[:len(s)-1]
+	}
+	rate, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || rate < 0 {
+		return 0, fmt.Errorf("invalid rate %q, want bytes per second with an optional K, M or G suffix", s)
+	}
+	return rate * multiplier, nil
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// A call rejected by a RateLimiter keeps its booked bytes this long after
+// they are paid for
+const RATE_RESERVATION_TTL = time.Minute
+
+// RateLimitedError is returned by RateLimiter.Reserve when the wait would
+// outlast the caller's deadline. The call should be repeated after
+// RetryAfter.
+type RateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("rate limit exceeded, retry after %v", e.RetryAfter)
+}
+
+// RateLimiter paces transfers to the rate of its schedule. It is a token
+// bucket holding at most one second of transfer, which may go into debt so
+// that a transfer larger than the bucket still gets through; the next one
+// waits until the debt is paid off. A nil RateLimiter does not limit.
+type RateLimiter struct {
+	schedule *RateSchedule
+
+	mu       sync.Mutex
+	tokens   float64
+	last     time.Time
+	reserved map[string]time.Time
+}
+
+func NewRateLimiter(schedule *RateSchedule) *RateLimiter {
+	return &RateLimiter{schedule: schedule, last: time.Now(), reserved: make(map[string]time.Time)}
+}
+
+// Wait takes n bytes from the bucket, blocking until the bucket is out of
+// debt or ctx is done
+func (l *RateLimiter) Wait(ctx context.Context, n int) error {
+	return l.Reserve(ctx, "", n)
+}
+
+// Reserve is Wait for a server, which cannot hold a call past its deadline.
+// If the bucket is not out of debt by then, the n bytes are booked for key
+// anyway and a *RateLimitedError says when the debt is paid off. A call with
+// the same key coming back then goes through without paying again, so a
+// transfer gets through under any rate. An empty key books nothing.
+func (l *RateLimiter) Reserve(ctx context.Context, key string, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	deadline, hasDeadline := ctx.Deadline()
+	l.mu.Lock()
+	now := time.Now()
+	ready, booked := l.reserved[key]
+	if booked {
+		delete(l.reserved, key)
+	} else {
+		rate := float64(l.schedule.RateAt(now))
+		if rate <= 0 {
+			l.mu.Unlock()
+			return nil
+		}
+		l.tokens += now.Sub(l.last).Seconds() * rate
+		if l.tokens > rate {
+			l.tokens = rate
+		}
+		l.last = now
+
+		ready = now
+		if l.tokens < 0 {
+			ready = now.Add(time.Duration(-l.tokens / rate * float64(time.Second)))
+		}
+		if key == "" && hasDeadline && ready.After(deadline) {
+			l.mu.Unlock()
+			return &RateLimitedError{RetryAfter: ready.Sub(now)}
+		}
+		l.tokens -= float64(n)
+	}
+	if hasDeadline && ready.After(deadline) {
+		l.book(key, ready, now)
+		l.mu.Unlock()
+		return &RateLimitedError{RetryAfter: ready.Sub(now)}
+	}
+	l.mu.Unlock()
+
+	delay := ready.Sub(now)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// book records that key may go through at ready. Bookings whose caller did
+// not come back within RATE_RESERVATION_TTL are dropped.
+func (l *RateLimiter) book(key string, ready time.Time, now time.Time) {
+	for other, otherReady := range l.reserved {
+		if now.Sub(otherReady) > RATE_RESERVATION_TTL {
+			delete(l.reserved, other)
+		}
+	}
+	l.reserved[key] = ready
+}
+
+// idle reports whether the limiter has nothing left to remember at now: it
+// was last used more than RATE_RESERVATION_TTL ago, its bucket has filled
+// up again and none of its bookings is still due
+func (l *RateLimiter) idle(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.last) <= RATE_RESERVATION_TTL {
+		return false
+	}
+	for _, ready := range l.reserved {
+		if now.Sub(ready) <= RATE_RESERVATION_TTL {
+			return false
+		}
+	}
+	rate := float64(l.schedule.RateAt(now))
+	return l.tokens+now.Sub(l.last).Seconds()*rate >= rate
+}
+
+// BlockRateLimiter limits the block bytes each client of a BlockStore
+// transfers. Clients are told apart by their user, or by their address if
+// they are anonymous. The limiters of clients that went idle are dropped
+// every RATE_RESERVATION_TTL.
+type BlockRateLimiter struct {
+	schedule *RateSchedule
+
+	mu       sync.Mutex
+	limiters map[string]*RateLimiter
+	swept    time.Time
+}
+
+func NewBlockRateLimiter(schedule *RateSchedule) *BlockRateLimiter {
+	return &BlockRateLimiter{schedule: schedule, limiters: make(map[string]*RateLimiter)}
+}
+
+// UnaryInterceptor paces PutBlock before the block is stored and GetBlock
+// before the block is returned. A call that cannot be served before its
+// deadline fails with Unavailable and a RetryInfo detail saying when its
+// bytes are paid for, so the client comes back then and goes through.
+func (b *BlockRateLimiter) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !strings.HasPrefix(info.FullMethod, "/surfstore.BlockStore/") {
+			return handler(ctx, req)
+		}
+		limiter := b.limiter(ctx)
+
+		if block, ok := req.(*Block); ok {
+			key := info.FullMethod + " " + GetBlockHashString(block.BlockData)
+			if err := b.wait(ctx, limiter, key, len(block.BlockData)); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := handler(ctx, req)
+		if block, ok := resp.(*Block); ok && block != nil && err == nil {
+			key := info.FullMethod + " " + req.(*BlockHash).Hash
+			if err := b.wait(ctx, limiter, key, len(block.BlockData)); err != nil {
+				return nil, err
+			}
+		}
+		return resp, err
+	}
+}
+
+func (b *BlockRateLimiter) wait(ctx context.Context, limiter *RateLimiter, key string, n int) error {
+	err := limiter.Reserve(ctx, key, n)
+	if limited, ok := err.(*RateLimitedError); ok {
+		st := status.Newf(codes.Unavailable, "BlockStore rate limit of %d bytes/s exceeded", b.schedule.RateAt(time.Now()))
+		if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(limited.RetryAfter)}); err == nil {
+			st = detailed
+		}
+		return st.Err()
+	}
+	if err != nil {
+		return status.FromContextError(err).Err()
+	}
+	return nil
+}
+
+func (b *BlockRateLimiter) limiter(ctx context.Context) *RateLimiter {
+	client := UserFromContext(ctx)
+	if client == "" {
+		if p, ok := peer.FromContext(ctx); ok {
+			client = p.Addr.String()
+			if i := strings.LastIndex(client, ":"); i >= 0 {
+				client = client[:i]
+			}
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now := time.Now(); now.Sub(b.swept) > RATE_RESERVATION_TTL {
+		for other, limiter := range b.limiters {
+			if limiter.idle(now) {
+				delete(b.limiters, other)
+			}
+		}
+		b.swept = now
+	}
+	limiter, ok := b.limiters[client]
+	if !ok {
+		limiter = NewRateLimiter(b.schedule)
+		b.limiters[client] = limiter
+	}
+	return limiter
+}
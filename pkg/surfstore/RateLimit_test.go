@@ -0,0 +1,173 @@
+package surfstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBlockRateLimiterMissingBlock(t *testing.T) {
+	limiter := NewBlockRateLimiter(&RateSchedule{})
+	addr, _, _ := startTestServer(t, grpc.ChainUnaryInterceptor(limiter.UnaryInterceptor()))
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = NewBlockStoreClient(conn).GetBlock(context.Background(), &BlockHash{Hash: GetBlockHashString([]byte("missing"))})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("GetBlock of a missing block = %v, want NotFound", err)
+	}
+}
+
+func TestParseRateSchedule(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 1, 1, hour, minute, 0, 0, time.Local)
+	}
+	tests := []struct {
+		spec    string
+		want    *RateSchedule
+		wantErr bool
+		rates   map[time.Time]int64
+	}{
+		{spec: "", want: &RateSchedule{}, rates: map[time.Time]int64{at(12, 0): 0}},
+		{spec: "512", want: &RateSchedule{Rate: 512}},
+		{spec: "2K", want: &RateSchedule{Rate: 2 << 10}},
+		{
+			spec:  "10M,09:00-18:00=1M",
+			want:  &RateSchedule{Rate: 10 << 20, Windows: []RateWindow{{Start: 9 * 60, End: 18 * 60, Rate: 1 << 20}}},
+			rates: map[time.Time]int64{at(8, 59): 10 << 20, at(9, 0): 1 << 20, at(17, 59): 1 << 20, at(18, 0): 10 << 20},
+		},
+		{
+			spec:  "0,22:00-06:00=1G",
+			want:  &RateSchedule{Windows: []RateWindow{{Start: 22 * 60, End: 6 * 60, Rate: 1 << 30}}},
+			rates: map[time.Time]int64{at(23, 0): 1 << 30, at(5, 59): 1 << 30, at(6, 0): 0, at(12, 0): 0},
+		},
+		{spec: "fast", wantErr: true},
+		{spec: "-1", wantErr: true},
+		{spec: "1M,09:00=1K", wantErr: true},
+		{spec: "1M,25:00-26:00=1K", wantErr: true},
+	}
+	for _, tt := range tests {
+		schedule, err := ParseRateSchedule(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseRateSchedule(%q) = %+v, want an error", tt.spec, schedule)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(schedule, tt.want) {
+			t.Errorf("ParseRateSchedule(%q) = %+v, %v, want %+v", tt.spec, schedule, err, tt.want)
+			continue
+		}
+		for when, want := range tt.rates {
+			if got := schedule.RateAt(when); got != want {
+				t.Errorf("%q at %s: rate %d, want %d", tt.spec, when.Format("15:04"), got, want)
+			}
+		}
+	}
+}
+
+func TestRateLimiterReserveBooks(t *testing.T) {
+	limiter := NewRateLimiter(&RateSchedule{Rate: 100000})
+	deadline := func() context.Context {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		t.Cleanup(cancel)
+		return ctx
+	}
+
+	// the first transfer puts the bucket 20ms into debt
+	if err := limiter.Reserve(deadline(), "a", 2000); err != nil {
+		t.Fatalf("first reservation: %v", err)
+	}
+	err := limiter.Reserve(deadline(), "b", 2000)
+	var limited *RateLimitedError
+	if !errors.As(err, &limited) || limited.RetryAfter <= 0 {
+		t.Fatalf("second reservation = %v, want a RateLimitedError", err)
+	}
+
+	// coming back once the debt is paid goes through without paying again
+	time.Sleep(limited.RetryAfter)
+	if err := limiter.Reserve(deadline(), "b", 2000); err != nil {
+		t.Errorf("booked reservation: %v", err)
+	}
+	if _, booked := limiter.reserved["b"]; booked {
+		t.Error("the booking was not used up")
+	}
+}
+
+func TestBlockRateLimiterRetryInfo(t *testing.T) {
+	limiter := NewBlockRateLimiter(&RateSchedule{Rate: 10000})
+	addr, _, _ := startTestServer(t, grpc.ChainUnaryInterceptor(limiter.UnaryInterceptor()))
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := NewBlockStoreClient(conn)
+	put := func(block *Block) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err := client.PutBlock(ctx, block)
+		return err
+	}
+
+	first := &Block{BlockData: bytes.Repeat([]byte("a"), 4000), BlockSize: 4000}
+	second := &Block{BlockData: bytes.Repeat([]byte("b"), 4000), BlockSize: 4000}
+	if err := put(first); err != nil {
+		t.Fatalf("first PutBlock: %v", err)
+	}
+	err = put(second)
+	after := retryAfter(err)
+	if status.Code(err) != codes.Unavailable || after <= 0 {
+		t.Fatalf("second PutBlock = %v, want Unavailable with a RetryInfo", err)
+	}
+	time.Sleep(after)
+	if err := put(second); err != nil {
+		t.Errorf("PutBlock after the RetryInfo delay: %v", err)
+	}
+}
+
+func TestBlockRateLimiterEvictsIdleLimiters(t *testing.T) {
+	b := NewBlockRateLimiter(&RateSchedule{Rate: 1000})
+	longAgo := time.Now().Add(-2 * RATE_RESERVATION_TTL)
+	tests := []struct {
+		user     string
+		tokens   float64
+		last     time.Time
+		reserved map[string]time.Time
+		kept     bool
+	}{
+		{user: "idle", tokens: 0, last: longAgo},
+		{user: "recent", tokens: 1000, last: time.Now(), kept: true},
+		{user: "in debt", tokens: -1000 * 1000, last: longAgo, kept: true},
+		{user: "booked", tokens: 0, last: longAgo, reserved: map[string]time.Time{"k": time.Now().Add(time.Second)}, kept: true},
+		{user: "stale booking", tokens: 0, last: longAgo, reserved: map[string]time.Time{"k": longAgo}},
+	}
+	for _, tt := range tests {
+		limiter := b.limiter(userContext(tt.user))
+		limiter.tokens, limiter.last = tt.tokens, tt.last
+		if tt.reserved != nil {
+			limiter.reserved = tt.reserved
+		}
+	}
+
+	b.swept = time.Time{}
+	b.limiter(userContext("carol"))
+	for _, tt := range tests {
+		if _, kept := b.limiters[tt.user]; kept != tt.kept {
+			t.Errorf("limiter of %q kept = %v, want %v", tt.user, kept, tt.kept)
+		}
+	}
+	if _, ok := b.limiters["carol"]; !ok {
+		t.Error("no limiter for the new client")
+	}
+}
@@ -1,10 +1,63 @@
 package surfstore
 
 const DEFAULT_META_FILENAME string = "index.txt"
+const DEFAULT_SEQ_FILENAME string = "index.seq"
+const DEFAULT_JOURNAL_FILENAME string = "index.journal"
+const TEMP_FILE_SUFFIX string = ".tmp"
+const IGNORE_FILENAME string = ".surfignore"
 
+// A download is written next to the file it replaces, under this prefix,
+// and renamed into place once complete
+const PARTIAL_DOWNLOAD_PREFIX string = ".surfdownload-"
+
+// Older clients marked a deleted file with this single block hash
+const LEGACY_TOMBSTONE_HASH string = "0"
+
+const INDEX_FORMAT_NAME string = "surfstore-index"
+const INDEX_FORMAT_VERSION int = 2
+
+// Fields of a line in the legacy index format
 const FILENAME_INDEX int = 0
 const VERSION_INDEX int = 1
 const HASH_LIST_INDEX int = 2
 
 const CONFIG_DELIMITER string = ","
 const HASH_DELIMITER string = " "
+
+const AUTH_METADATA_KEY string = "authorization"
+const AUTH_SCHEME string = "Bearer "
+const NAMESPACE_METADATA_KEY string = "surfstore-namespace"
+const ANYONE_PRINCIPAL string = "*"
+
+// The MetaStore authenticates to the BlockStore as this user, with its
+// token from the server's token file, to attribute blocks
+const METASTORE_USER string = "@metastore"
+
+// ListFiles returns this many files per page unless asked for fewer
+const DEFAULT_LIST_PAGE_SIZE int32 = 1000
+const MAX_LIST_PAGE_SIZE int32 = 10000
+const MAX_LIST_PAGE_BYTES int = 1 << 20
+
+// The MetaStore keeps the latest changes, from MAX_CHANGE_LOG_LENGTH/2 to
+// MAX_CHANGE_LOG_LENGTH of them. Clients further behind list every file.
+const MAX_CHANGE_LOG_LENGTH int = 100000
+
+// Retried calls allow for this many bytes per second on top of their
+// timeout, e.g. 33s for a block of MAX_BLOCK_SIZE
+const DEFAULT_MIN_THROUGHPUT int64 = 64 << 10
+
+// Block sizes the MetaStore accepts unless configured otherwise. Blocks
+// have to fit in a gRPC message, which is limited to 4 MiB.
+const DEFAULT_BLOCK_SIZE int32 = 4096
+const MIN_BLOCK_SIZE int32 = 1
+const MAX_BLOCK_SIZE int32 = 1 << 21
+
+// A block list stored as a tree has this many hashes per index block. An
+// index block starts with a header line naming its level, 0 for the index
+// blocks that list data blocks.
+const BLOCK_TREE_FANOUT int = 1024
+const BLOCK_TREE_HEADER string = "surfstore-block-tree"
+
+// HasBlocks is asked about at most this many hashes at a time, so the
+// block lists of huge files fit in a gRPC message
+const HAS_BLOCKS_BATCH_SIZE int = 10000
@@ -26,6 +26,8 @@ type BlockStoreClient interface {
 	GetBlock(ctx context.Context, in *BlockHash, opts ...grpc.CallOption) (*Block, error)
 	PutBlock(ctx context.Context, in *Block, opts ...grpc.CallOption) (*Success, error)
 	HasBlocks(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*BlockHashes, error)
+	GetUsage(ctx context.Context, in *UsageRequest, opts ...grpc.CallOption) (*UsageReport, error)
+	AttributeBlocks(ctx context.Context, opts ...grpc.CallOption) (BlockStore_AttributeBlocksClient, error)
 }
 
 type blockStoreClient struct {
@@ -63,6 +65,49 @@ func (c *blockStoreClient) HasBlocks(ctx context.Context, in *BlockHashes, opts
 	return out, nil
 }
 
+func (c *blockStoreClient) GetUsage(ctx context.Context, in *UsageRequest, opts ...grpc.CallOption) (*UsageReport, error) {
+	out := new(UsageReport)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/GetUsage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blockStoreClient) AttributeBlocks(ctx context.Context, opts ...grpc.CallOption) (BlockStore_AttributeBlocksClient, error) {
+	stream, err := c.cc.NewStream(ctx, &BlockStore_ServiceDesc.Streams[0], "/surfstore.BlockStore/AttributeBlocks", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &blockStoreAttributeBlocksClient{stream}
+	return x, nil
+}
+
+type BlockStore_AttributeBlocksClient interface {
+	Send(*BlockAttribution) error
+	CloseAndRecv() (*Success, error)
+	grpc.ClientStream
+}
+
+type blockStoreAttributeBlocksClient struct {
+	grpc.ClientStream
+}
+
+func (x *blockStoreAttributeBlocksClient) Send(m *BlockAttribution) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *blockStoreAttributeBlocksClient) CloseAndRecv() (*Success, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(Success)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // BlockStoreServer is the server API for BlockStore service.
 // All implementations must embed UnimplementedBlockStoreServer
 // for forward compatibility
@@ -70,6 +115,8 @@ type BlockStoreServer interface {
 	GetBlock(context.Context, *BlockHash) (*Block, error)
 	PutBlock(context.Context, *Block) (*Success, error)
 	HasBlocks(context.Context, *BlockHashes) (*BlockHashes, error)
+	GetUsage(context.Context, *UsageRequest) (*UsageReport, error)
+	AttributeBlocks(BlockStore_AttributeBlocksServer) error
 	mustEmbedUnimplementedBlockStoreServer()
 }
 
@@ -86,6 +133,12 @@ func (UnimplementedBlockStoreServer) PutBlock(context.Context, *Block) (*Success
 func (UnimplementedBlockStoreServer) HasBlocks(context.Context, *BlockHashes) (*BlockHashes, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method HasBlocks not implemented")
 }
+func (UnimplementedBlockStoreServer) GetUsage(context.Context, *UsageRequest) (*UsageReport, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUsage not implemented")
+}
+func (UnimplementedBlockStoreServer) AttributeBlocks(BlockStore_AttributeBlocksServer) error {
+	return status.Errorf(codes.Unimplemented, "method AttributeBlocks not implemented")
+}
 func (UnimplementedBlockStoreServer) mustEmbedUnimplementedBlockStoreServer() {}
 
 // UnsafeBlockStoreServer may be embedded to opt out of forward compatibility for this service.
@@ -153,6 +206,50 @@ func _BlockStore_HasBlocks_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _BlockStore_GetUsage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UsageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).GetUsage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/GetUsage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).GetUsage(ctx, req.(*UsageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BlockStore_AttributeBlocks_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(BlockStoreServer).AttributeBlocks(&blockStoreAttributeBlocksServer{stream})
+}
+
+type BlockStore_AttributeBlocksServer interface {
+	SendAndClose(*Success) error
+	Recv() (*BlockAttribution, error)
+	grpc.ServerStream
+}
+
+type blockStoreAttributeBlocksServer struct {
+	grpc.ServerStream
+}
+
+func (x *blockStoreAttributeBlocksServer) SendAndClose(m *Success) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *blockStoreAttributeBlocksServer) Recv() (*BlockAttribution, error) {
+	m := new(BlockAttribution)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // BlockStore_ServiceDesc is the grpc.ServiceDesc for BlockStore service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -172,8 +269,18 @@ var BlockStore_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "HasBlocks",
 			Handler:    _BlockStore_HasBlocks_Handler,
 		},
+		{
+			MethodName: "GetUsage",
+			Handler:    _BlockStore_GetUsage_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "AttributeBlocks",
+			Handler:       _BlockStore_AttributeBlocks_Handler,
+			ClientStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/surfstore/SurfStore.proto",
 }
 
@@ -182,8 +289,18 @@ var BlockStore_ServiceDesc = grpc.ServiceDesc{
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type MetaStoreClient interface {
 	GetFileInfoMap(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FileInfoMap, error)
+	ListFiles(ctx context.Context, in *ListFilesRequest, opts ...grpc.CallOption) (*ListFilesResponse, error)
 	UpdateFile(ctx context.Context, in *FileMetaData, opts ...grpc.CallOption) (*Version, error)
+	UpdateFiles(ctx context.Context, in *FileInfoMap, opts ...grpc.CallOption) (*FileInfoMap, error)
 	GetBlockStoreAddr(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddr, error)
+	GetBlockSizeRange(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockSizeRange, error)
+	GrantAccess(ctx context.Context, in *AccessRequest, opts ...grpc.CallOption) (*Success, error)
+	RevokeAccess(ctx context.Context, in *AccessRequest, opts ...grpc.CallOption) (*Success, error)
+	GetUsage(ctx context.Context, in *UsageRequest, opts ...grpc.CallOption) (*UsageReport, error)
+	GetChangesSince(ctx context.Context, in *ChangeRequest, opts ...grpc.CallOption) (*ChangeList, error)
+	WatchFiles(ctx context.Context, in *ChangeRequest, opts ...grpc.CallOption) (MetaStore_WatchFilesClient, error)
+	RenameFile(ctx context.Context, in *RenameRequest, opts ...grpc.CallOption) (*FileInfoMap, error)
+	UndeleteFile(ctx context.Context, in *UndeleteRequest, opts ...grpc.CallOption) (*Version, error)
 }
 
 type metaStoreClient struct {
@@ -203,6 +320,15 @@ func (c *metaStoreClient) GetFileInfoMap(ctx context.Context, in *emptypb.Empty,
 	return out, nil
 }
 
+func (c *metaStoreClient) ListFiles(ctx context.Context, in *ListFilesRequest, opts ...grpc.CallOption) (*ListFilesResponse, error) {
+	out := new(ListFilesResponse)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/ListFiles", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *metaStoreClient) UpdateFile(ctx context.Context, in *FileMetaData, opts ...grpc.CallOption) (*Version, error) {
 	out := new(Version)
 	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/UpdateFile", in, out, opts...)
@@ -212,6 +338,15 @@ func (c *metaStoreClient) UpdateFile(ctx context.Context, in *FileMetaData, opts
 	return out, nil
 }
 
+func (c *metaStoreClient) UpdateFiles(ctx context.Context, in *FileInfoMap, opts ...grpc.CallOption) (*FileInfoMap, error) {
+	out := new(FileInfoMap)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/UpdateFiles", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *metaStoreClient) GetBlockStoreAddr(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddr, error) {
 	out := new(BlockStoreAddr)
 	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetBlockStoreAddr", in, out, opts...)
@@ -221,13 +356,118 @@ func (c *metaStoreClient) GetBlockStoreAddr(ctx context.Context, in *emptypb.Emp
 	return out, nil
 }
 
+func (c *metaStoreClient) GetBlockSizeRange(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockSizeRange, error) {
+	out := new(BlockSizeRange)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetBlockSizeRange", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) GrantAccess(ctx context.Context, in *AccessRequest, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GrantAccess", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) RevokeAccess(ctx context.Context, in *AccessRequest, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/RevokeAccess", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) GetUsage(ctx context.Context, in *UsageRequest, opts ...grpc.CallOption) (*UsageReport, error) {
+	out := new(UsageReport)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetUsage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) GetChangesSince(ctx context.Context, in *ChangeRequest, opts ...grpc.CallOption) (*ChangeList, error) {
+	out := new(ChangeList)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetChangesSince", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) WatchFiles(ctx context.Context, in *ChangeRequest, opts ...grpc.CallOption) (MetaStore_WatchFilesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &MetaStore_ServiceDesc.Streams[0], "/surfstore.MetaStore/WatchFiles", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &metaStoreWatchFilesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type MetaStore_WatchFilesClient interface {
+	Recv() (*ChangeList, error)
+	grpc.ClientStream
+}
+
+type metaStoreWatchFilesClient struct {
+	grpc.ClientStream
+}
+
+func (x *metaStoreWatchFilesClient) Recv() (*ChangeList, error) {
+	m := new(ChangeList)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *metaStoreClient) RenameFile(ctx context.Context, in *RenameRequest, opts ...grpc.CallOption) (*FileInfoMap, error) {
+	out := new(FileInfoMap)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/RenameFile", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) UndeleteFile(ctx context.Context, in *UndeleteRequest, opts ...grpc.CallOption) (*Version, error) {
+	out := new(Version)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/UndeleteFile", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // MetaStoreServer is the server API for MetaStore service.
 // All implementations must embed UnimplementedMetaStoreServer
 // for forward compatibility
 type MetaStoreServer interface {
 	GetFileInfoMap(context.Context, *emptypb.Empty) (*FileInfoMap, error)
+	ListFiles(context.Context, *ListFilesRequest) (*ListFilesResponse, error)
 	UpdateFile(context.Context, *FileMetaData) (*Version, error)
+	UpdateFiles(context.Context, *FileInfoMap) (*FileInfoMap, error)
 	GetBlockStoreAddr(context.Context, *emptypb.Empty) (*BlockStoreAddr, error)
+	GetBlockSizeRange(context.Context, *emptypb.Empty) (*BlockSizeRange, error)
+	GrantAccess(context.Context, *AccessRequest) (*Success, error)
+	RevokeAccess(context.Context, *AccessRequest) (*Success, error)
+	GetUsage(context.Context, *UsageRequest) (*UsageReport, error)
+	GetChangesSince(context.Context, *ChangeRequest) (*ChangeList, error)
+	WatchFiles(*ChangeRequest, MetaStore_WatchFilesServer) error
+	RenameFile(context.Context, *RenameRequest) (*FileInfoMap, error)
+	UndeleteFile(context.Context, *UndeleteRequest) (*Version, error)
 	mustEmbedUnimplementedMetaStoreServer()
 }
 
@@ -238,12 +478,42 @@ type UnimplementedMetaStoreServer struct {
 func (UnimplementedMetaStoreServer) GetFileInfoMap(context.Context, *emptypb.Empty) (*FileInfoMap, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetFileInfoMap not implemented")
 }
+func (UnimplementedMetaStoreServer) ListFiles(context.Context, *ListFilesRequest) (*ListFilesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListFiles not implemented")
+}
 func (UnimplementedMetaStoreServer) UpdateFile(context.Context, *FileMetaData) (*Version, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method UpdateFile not implemented")
 }
+func (UnimplementedMetaStoreServer) UpdateFiles(context.Context, *FileInfoMap) (*FileInfoMap, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateFiles not implemented")
+}
 func (UnimplementedMetaStoreServer) GetBlockStoreAddr(context.Context, *emptypb.Empty) (*BlockStoreAddr, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreAddr not implemented")
 }
+func (UnimplementedMetaStoreServer) GetBlockSizeRange(context.Context, *emptypb.Empty) (*BlockSizeRange, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlockSizeRange not implemented")
+}
+func (UnimplementedMetaStoreServer) GrantAccess(context.Context, *AccessRequest) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GrantAccess not implemented")
+}
+func (UnimplementedMetaStoreServer) RevokeAccess(context.Context, *AccessRequest) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RevokeAccess not implemented")
+}
+func (UnimplementedMetaStoreServer) GetUsage(context.Context, *UsageRequest) (*UsageReport, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUsage not implemented")
+}
+func (UnimplementedMetaStoreServer) GetChangesSince(context.Context, *ChangeRequest) (*ChangeList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetChangesSince not implemented")
+}
+func (UnimplementedMetaStoreServer) WatchFiles(*ChangeRequest, MetaStore_WatchFilesServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchFiles not implemented")
+}
+func (UnimplementedMetaStoreServer) RenameFile(context.Context, *RenameRequest) (*FileInfoMap, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RenameFile not implemented")
+}
+func (UnimplementedMetaStoreServer) UndeleteFile(context.Context, *UndeleteRequest) (*Version, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UndeleteFile not implemented")
+}
 func (UnimplementedMetaStoreServer) mustEmbedUnimplementedMetaStoreServer() {}
 
 // UnsafeMetaStoreServer may be embedded to opt out of forward compatibility for this service.
@@ -275,6 +545,24 @@ func _MetaStore_GetFileInfoMap_Handler(srv interface{}, ctx context.Context, dec
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MetaStore_ListFiles_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListFilesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).ListFiles(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/ListFiles",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).ListFiles(ctx, req.(*ListFilesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _MetaStore_UpdateFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(FileMetaData)
 	if err := dec(in); err != nil {
@@ -293,6 +581,24 @@ func _MetaStore_UpdateFile_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MetaStore_UpdateFiles_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileInfoMap)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).UpdateFiles(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/UpdateFiles",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).UpdateFiles(ctx, req.(*FileInfoMap))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _MetaStore_GetBlockStoreAddr_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(emptypb.Empty)
 	if err := dec(in); err != nil {
@@ -311,6 +617,153 @@ func _MetaStore_GetBlockStoreAddr_Handler(srv interface{}, ctx context.Context,
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MetaStore_GetBlockSizeRange_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetBlockSizeRange(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetBlockSizeRange",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetBlockSizeRange(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GrantAccess_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AccessRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GrantAccess(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GrantAccess",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GrantAccess(ctx, req.(*AccessRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_RevokeAccess_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AccessRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).RevokeAccess(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/RevokeAccess",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).RevokeAccess(ctx, req.(*AccessRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetUsage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UsageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetUsage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetUsage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetUsage(ctx, req.(*UsageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetChangesSince_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ChangeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetChangesSince(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetChangesSince",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetChangesSince(ctx, req.(*ChangeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_WatchFiles_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ChangeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MetaStoreServer).WatchFiles(m, &metaStoreWatchFilesServer{stream})
+}
+
+type MetaStore_WatchFilesServer interface {
+	Send(*ChangeList) error
+	grpc.ServerStream
+}
+
+type metaStoreWatchFilesServer struct {
+	grpc.ServerStream
+}
+
+func (x *metaStoreWatchFilesServer) Send(m *ChangeList) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _MetaStore_RenameFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RenameRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).RenameFile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/RenameFile",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).RenameFile(ctx, req.(*RenameRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_UndeleteFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UndeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).UndeleteFile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/UndeleteFile",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).UndeleteFile(ctx, req.(*UndeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // MetaStore_ServiceDesc is the grpc.ServiceDesc for MetaStore service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -322,15 +775,57 @@ var MetaStore_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetFileInfoMap",
 			Handler:    _MetaStore_GetFileInfoMap_Handler,
 		},
+		{
+			MethodName: "ListFiles",
+			Handler:    _MetaStore_ListFiles_Handler,
+		},
 		{
 			MethodName: "UpdateFile",
 			Handler:    _MetaStore_UpdateFile_Handler,
 		},
+		{
+			MethodName: "UpdateFiles",
+			Handler:    _MetaStore_UpdateFiles_Handler,
+		},
 		{
 			MethodName: "GetBlockStoreAddr",
 			Handler:    _MetaStore_GetBlockStoreAddr_Handler,
 		},
+		{
+			MethodName: "GetBlockSizeRange",
+			Handler:    _MetaStore_GetBlockSizeRange_Handler,
+		},
+		{
+			MethodName: "GrantAccess",
+			Handler:    _MetaStore_GrantAccess_Handler,
+		},
+		{
+			MethodName: "RevokeAccess",
+			Handler:    _MetaStore_RevokeAccess_Handler,
+		},
+		{
+			MethodName: "GetUsage",
+			Handler:    _MetaStore_GetUsage_Handler,
+		},
+		{
+			MethodName: "GetChangesSince",
+			Handler:    _MetaStore_GetChangesSince_Handler,
+		},
+		{
+			MethodName: "RenameFile",
+			Handler:    _MetaStore_RenameFile_Handler,
+		},
+		{
+			MethodName: "UndeleteFile",
+			Handler:    _MetaStore_UndeleteFile_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchFiles",
+			Handler:       _MetaStore_WatchFiles_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/surfstore/SurfStore.proto",
 }
@@ -0,0 +1,159 @@
+package surfstore
+
+import (
+	context "context"
+	"fmt"
+	"strings"
+)
+
+// A block list can be stored as a tree of index blocks in the BlockStore, so
+// the metadata of a huge file only carries the hash of the root. An index
+// block of level 0 lists up to BLOCK_TREE_FANOUT data block hashes, one of
+// level n lists index blocks of level n-1. The tree of a block list is
+// always built the same way, so an edit that changes some blocks only
+// changes the index blocks above them, and the trees of two versions share
+// every other subtree.
+
+// blockTreeNode is an index block and the data block hashes below it
+type blockTreeNode struct {
+	hash   string
+	data   []byte
+	hashes []string
+}
+
+// buildBlockTree groups a block list into index blocks level by level until
+// one is left. It returns the nodes bottom up, the root last.
+func buildBlockTree(hashes []string) []blockTreeNode {
+	var nodes []blockTreeNode
+	// child i of the current level covers hashes[spans[i]:spans[i+1]]
+	children := hashes
+	spans := make([]int, len(hashes)+1)
+	for i := range spans {
+		spans[i] = i
+	}
+	for level := 0; ; level++ {
+		var parents []string
+		parentSpans := []int{0}
+		for first := 0; first == 0 || first < len(children); first += BLOCK_TREE_FANOUT {
+			last := first + BLOCK_TREE_FANOUT
+			if last > len(children) {
+				last = len(children)
+			}
+			data := []byte(fmt.Sprintf("%s %d\n%s", BLOCK_TREE_HEADER, level, strings.Join(children[first:last], "\n")))
+			node := blockTreeNode{hash: GetBlockHashString(data), data: data, hashes: hashes[spans[first]:spans[last]]}
+			nodes = append(nodes, node)
+			parents = append(parents, node.hash)
+			parentSpans = append(parentSpans, spans[last])
+		}
+		if len(parents) == 1 {
+			return nodes
+		}
+		children, spans = parents, parentSpans
+	}
+}
+
+// blockTreeRoot returns the root of a file's block tree, building it from
+// the block list if the file is not stored as a tree
+func blockTreeRoot(meta *FileMetaData) string {
+	if meta.BlockTreeRoot != "" {
+		return meta.BlockTreeRoot
+	}
+	nodes := buildBlockTree(meta.BlockHashList)
+	return nodes[len(nodes)-1].hash
+}
+
+// parseIndexBlock returns the level of an index block and the hashes it lists
+func parseIndexBlock(data []byte) (int, []string, error) {
+	lines := strings.Split(string(data), "\n")
+	var level int
+	if _, err := fmt.Sscanf(lines[0], BLOCK_TREE_HEADER+" %d", &level); err != nil || level < 0 {
+		return 0, nil, fmt.Errorf("not an index block: %q", lines[0])
+	}
+	if len(lines) == 2 && lines[1] == "" {
+		return level, nil, nil
+	}
+	return level, lines[1:], nil
+}
+
+// putBlockTree stores the block list of a file as a tree of index blocks
+// and returns its root. The index blocks the BlockStore already has, because
+// the part of the file below them did not change, are not sent again. The
+// root is put last, so a stored root means the whole tree is stored.
+func putBlockTree(ctx context.Context, client RPCClient, meta *FileMetaData, address string) (string, error) {
+	nodes := buildBlockTree(meta.BlockHashList)
+	hashes := make([]string, len(nodes))
+	for i, node := range nodes {
+		hashes[i] = node.hash
+	}
+	stored, err := hasBlocks(ctx, client, hashes, address)
+	if err != nil {
+		return "", err
+	}
+
+	for _, node := range nodes {
+		if stored[node.hash] {
+			continue
+		}
+		if err := client.UploadLimit.Wait(ctx, len(node.data)); err != nil {
+			return "", err
+		}
+		block := Block{BlockData: node.data, BlockSize: int32(len(node.data))}
+		var succ bool
+		if err := client.PutBlock(ctx, &block, NamespaceOf(meta.Filename), address, &succ); err != nil {
+			return "", err
+		}
+		stored[node.hash] = true
+	}
+	return nodes[len(nodes)-1].hash, nil
+}
+
+// expandBlockTree fetches the block list of a file stored as a tree. The
+// subtrees it shares with known, usually the local version of the file, are
+// taken from there, so only the index blocks of the changed parts are
+// downloaded.
+func expandBlockTree(ctx context.Context, client RPCClient, root string, address string, known *FileMetaData) ([]string, error) {
+	subtrees := make(map[string][]string)
+	if known != nil && len(known.BlockHashList) > 0 {
+		for _, node := range buildBlockTree(known.BlockHashList) {
+			subtrees[node.hash] = node.hashes
+		}
+	}
+
+	var hashes []string
+	// every level lists index blocks of the level below, down to 0
+	var expand func(hash string, level int) error
+	expand = func(hash string, level int) error {
+		if subtree, ok := subtrees[hash]; ok {
+			hashes = append(hashes, subtree...)
+			return nil
+		}
+		var block Block
+		if err := client.GetBlock(ctx, hash, address, &block); err != nil {
+			return err
+		}
+		if GetBlockHashString(block.BlockData) != hash {
+			return fmt.Errorf("index block %s does not match its hash", hash)
+		}
+		blockLevel, children, err := parseIndexBlock(block.BlockData)
+		if err != nil {
+			return err
+		}
+		if level >= 0 && blockLevel != level {
+			return fmt.Errorf("index block %s has level %d, expected %d", hash, blockLevel, level)
+		}
+		if blockLevel == 0 {
+			hashes = append(hashes, children...)
+			return nil
+		}
+		for _, child := range children {
+			if err := expand(child, blockLevel-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := expand(root, -1); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
@@ -0,0 +1,136 @@
+package surfstore
+
+import (
+	context "context"
+	"log"
+	"time"
+)
+
+// DaemonOptions tunes the continuous sync loop of RunDaemon
+type DaemonOptions struct {
+	// Debounce is how long the base directory has to stay quiet after a
+	// local edit before it is synced. MaxDelay caps the wait during a
+	// long burst of edits.
+	Debounce time.Duration
+	MaxDelay time.Duration
+
+	// Failed syncs and dropped watch streams are retried after a backoff
+	// that doubles from MinBackoff up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Sync is passed to every ClientSync the daemon runs
+	Sync SyncOptions
+}
+
+func DefaultDaemonOptions() DaemonOptions {
+	return DaemonOptions{
+		Debounce:   500 * time.Millisecond,
+		MaxDelay:   5 * time.Second,
+		MinBackoff: time.Second,
+		MaxBackoff: time.Minute,
+	}
+}
+
+// RunDaemon keeps the base directory in sync until ctx is done. It syncs
+// once at startup, after local edits settle, and whenever the MetaStore
+// pushes a remote change.
+func RunDaemon(ctx context.Context, client RPCClient, opts DaemonOptions) error {
+	localEvents := make(chan struct{}, 1)
+	if err := watchLocalChanges(ctx, client.BaseDir, localEvents); err != nil {
+		return err
+	}
+	remoteEvents := make(chan struct{}, 1)
+	go watchRemoteChanges(ctx, client, remoteEvents, opts)
+
+	// fires when a sync is due: after the debounce, or after a backoff
+	syncTimer := time.NewTimer(0)
+	defer syncTimer.Stop()
+	var firstEdit time.Time
+	backoff := opts.MinBackoff
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-localEvents:
+			now := time.Now()
+			if firstEdit.IsZero() {
+				firstEdit = now
+			}
+			delay := opts.Debounce
+			if deadline := firstEdit.Add(opts.MaxDelay); now.Add(delay).After(deadline) {
+				delay = deadline.Sub(now)
+			}
+			resetTimer(syncTimer, delay)
+
+		case <-remoteEvents:
+			resetTimer(syncTimer, 0)
+
+		case <-syncTimer.C:
+			firstEdit = time.Time{}
+			if _, err := ClientSync(ctx, client, opts.Sync); err != nil {
+				log.Printf("[Daemon %s] sync failed, retrying in %v: %v\n", client.BaseDir, backoff, err)
+				resetTimer(syncTimer, backoff)
+				backoff = nextBackoff(backoff, opts)
+				continue
+			}
+			backoff = opts.MinBackoff
+		}
+	}
+}
+
+// watchRemoteChanges follows the MetaStore's WatchFiles stream and signals
+// remoteEvents on every change. Dropped streams are reopened with backoff
+// and resume from the last sequence number received.
+func watchRemoteChanges(ctx context.Context, client RPCClient, remoteEvents chan<- struct{}, opts DaemonOptions) {
+	epoch, seq := "", int64(0)
+	backoff := opts.MinBackoff
+
+	for {
+		err := client.WatchFiles(ctx, epoch, seq, func(changes *ChangeList) error {
+			epoch, seq = changes.Epoch, changes.LatestSeq
+			backoff = opts.MinBackoff
+			signal(remoteEvents)
+			return nil
+		})
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("[Daemon %s] watch stream dropped, reconnecting in %v: %v\n", client.BaseDir, backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = nextBackoff(backoff, opts)
+	}
+}
+
+// signal does a non-blocking send, so pending events coalesce
+func signal(events chan<- struct{}) {
+	select {
+	case events <- struct{}{}:
+	default:
+	}
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+func nextBackoff(backoff time.Duration, opts DaemonOptions) time.Duration {
+	backoff *= 2
+	if backoff > opts.MaxBackoff {
+		backoff = opts.MaxBackoff
+	}
+	return backoff
+}
@@ -1,16 +1,24 @@
 package surfstore
 
 import (
-	"bufio"
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
 )
 
 /* Hash Related */
@@ -25,6 +33,23 @@ func GetBlockHashString(blockData []byte) string {
 	return hex.EncodeToString(blockHash)
 }
 
+// SameContent reports whether two files hold the same bytes, using only
+// their metadata. ok is false when the metadata cannot tell, which happens
+// when a content hash is missing and the files were chunked with different
+// block sizes.
+func SameContent(a *FileMetaData, b *FileMetaData) (same bool, ok bool) {
+	if a.SymlinkTarget != "" || b.SymlinkTarget != "" {
+		return a.SymlinkTarget == b.SymlinkTarget, true
+	}
+	if a.ContentHash != "" && b.ContentHash != "" {
+		return a.ContentHash == b.ContentHash && a.Size == b.Size, true
+	}
+	if sameHashes(a, b) {
+		return true, true
+	}
+	return false, a.BlockSize == b.BlockSize
+}
+
 /* File Path Related */
 func ConcatPath(baseDir, fileDir string) string {
 	return baseDir + "/" + fileDir
@@ -34,8 +59,318 @@ func ConcatPath(baseDir, fileDir string) string {
 	Reading and Writing Local Metadata File Related
 */
 
+// LocalIndex is the client's view of the server as of its last sync: the
+// metadata of every synced file and the change sequence number it is at.
+// Selection lists the path prefixes the client syncs, empty means all, and
+// IgnoreHash identifies the ignore patterns it synced with. Stats caches
+// what the local scan last saw of each file.
+type LocalIndex struct {
+	Epoch      string
+	LastSeq    int64
+	Selection  []string
+	IgnoreHash string
+	Files      map[string]*FileMetaData
+	Stats      map[string]*FileStat
+}
+
+// FileStat is what the local scan last saw of a file when its content
+// matched the block hashes in the index. While the file's stat is unchanged
+// the hashes are trusted without reading the file again.
+type FileStat struct {
+	Size      int64  `json:"size"`
+	ModTime   int64  `json:"mtime"`
+	Inode     uint64 `json:"inode,omitempty"`
+	BlockSize int    `json:"blockSize"`
+}
+
+// normalizeSelection turns path prefixes into sorted, slash-separated paths
+// relative to the base directory. A prefix naming the base directory itself
+// selects everything, which is stored as an empty selection.
+func normalizeSelection(prefixes []string) []string {
+	var selection []string
+	for _, prefix := range prefixes {
+		prefix = strings.Trim(path.Clean(filepath.ToSlash(prefix)), "/")
+		if prefix == "" || prefix == "." {
+			return nil
+		}
+		selection = append(selection, prefix)
+	}
+	sort.Strings(selection)
+	return selection
+}
+
+// Selected reports whether a file falls under the index's selection
+func (index *LocalIndex) Selected(fileName string) bool {
+	if len(index.Selection) == 0 {
+		return true
+	}
+	for _, prefix := range index.Selection {
+		if fileName == prefix || strings.HasPrefix(fileName, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// indexHeader is the first line of a versioned index file. The checksum
+// covers every byte after the header line.
+type indexHeader struct {
+	Format     string   `json:"format"`
+	Version    int      `json:"version"`
+	Epoch      string   `json:"epoch,omitempty"`
+	LastSeq    int64    `json:"lastSeq,omitempty"`
+	Selection  []string `json:"selection,omitempty"`
+	IgnoreHash string   `json:"ignoreHash,omitempty"`
+	Entries    int      `json:"entries"`
+	Checksum   string   `json:"checksum"`
+}
+
+// indexEntry is one line of a versioned index file
+type indexEntry struct {
+	File json.RawMessage `json:"file"`
+	Stat *FileStat       `json:"stat,omitempty"`
+}
+
+// IsMetaFile reports whether a base directory entry holds client
+// metadata rather than a file to sync. Partial downloads count as metadata
+// in every directory.
+func IsMetaFile(filename string) bool {
+	return IsPartialDownload(path.Base(filename)) ||
+		filename == DEFAULT_META_FILENAME ||
+		filename == DEFAULT_META_FILENAME+TEMP_FILE_SUFFIX ||
+		filename == DEFAULT_SEQ_FILENAME ||
+		filename == DEFAULT_JOURNAL_FILENAME ||
+		filename == DEFAULT_JOURNAL_FILENAME+TEMP_FILE_SUFFIX
+}
+
+// IsPartialDownload reports whether a directory entry is a file that is
+// still being downloaded
+func IsPartialDownload(name string) bool {
+	return strings.HasPrefix(name, PARTIAL_DOWNLOAD_PREFIX)
+}
+
+// ValidFileName returns an error unless a file name is a clean,
+// slash-separated path that stays inside the base directory and is not
+// client metadata. "../x", "/etc/passwd", "a/./b" and "a//b" are invalid.
+func ValidFileName(fileName string) error {
+	if fileName == "" || fileName == "." || path.Clean(fileName) != fileName || path.IsAbs(fileName) ||
+		fileName == ".." || strings.HasPrefix(fileName, "../") || strings.ContainsRune(fileName, 0) {
+		return fmt.Errorf("invalid file name %q", fileName)
+	}
+	if IsMetaFile(fileName) {
+		return fmt.Errorf("file name %q is reserved for client metadata", fileName)
+	}
+	return nil
+}
+
+// normalizeTombstone turns the single "0" block hash older clients marked
+// a deleted file with into the Deleted field
+func normalizeTombstone(meta *FileMetaData) {
+	if len(meta.BlockHashList) == 1 && meta.BlockHashList[0] == LEGACY_TOMBSTONE_HASH {
+		meta.Deleted = true
+		meta.BlockHashList = nil
+		meta.Size = 0
+	}
+}
+
+// LoadLocalIndex reads the local metadata file. A missing file is an
+// empty index, and an index in the legacy text format is migrated.
+func LoadLocalIndex(baseDir string) (*LocalIndex, error) {
+	index := &LocalIndex{Files: make(map[string]*FileMetaData), Stats: make(map[string]*FileStat)}
+
+	content, err := os.ReadFile(ConcatPath(baseDir, DEFAULT_META_FILENAME))
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading index: %w", err)
+	}
+
+	if len(content) == 0 {
+		return index, nil
+	}
+
+	// a legacy file name may well start with {, so only a first line that
+	// is a JSON object with a version is a header
+	headerLine, body := content, []byte{}
+	if i := bytes.IndexByte(content, '\n'); i >= 0 {
+		headerLine, body = content[:i], content[i+1:]
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(headerLine, &fields); err != nil || fields["version"] == nil {
+		return loadLegacyIndex(baseDir, content)
+	}
+	var header indexHeader
+	if err := json.Unmarshal(headerLine, &header); err != nil {
+		return nil, fmt.Errorf("reading index header: %w", err)
+	}
+	if header.Format != INDEX_FORMAT_NAME {
+		return nil, fmt.Errorf("%s is not a surfstore index", DEFAULT_META_FILENAME)
+	}
+	if header.Version > INDEX_FORMAT_VERSION {
+		return nil, fmt.Errorf("index format version %d is newer than the supported version %d", header.Version, INDEX_FORMAT_VERSION)
+	}
+	if GetBlockHashString(body) != header.Checksum {
+		return nil, fmt.Errorf("index checksum mismatch, %s is corrupt", DEFAULT_META_FILENAME)
+	}
+
+	index.Epoch = header.Epoch
+	index.LastSeq = header.LastSeq
+	index.Selection = header.Selection
+	index.IgnoreHash = header.IgnoreHash
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var entry indexEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("reading index entry: %w", err)
+		}
+		fileMeta := &FileMetaData{}
+		if err := protojson.Unmarshal(entry.File, fileMeta); err != nil {
+			return nil, fmt.Errorf("reading index entry: %w", err)
+		}
+		normalizeTombstone(fileMeta)
+		index.Files[fileMeta.Filename] = fileMeta
+		if entry.Stat != nil {
+			index.Stats[fileMeta.Filename] = entry.Stat
+		}
+	}
+	if len(index.Files) != header.Entries {
+		return nil, fmt.Errorf("index has %d entries but its header says %d", len(index.Files), header.Entries)
+	}
+
+	return index, nil
+}
+
+// Write atomically replaces the local metadata file: the index is written
+// to a temporary file which is then renamed over the old one.
+func (index *LocalIndex) Write(baseDir string) error {
+	fileNames := make([]string, 0, len(index.Files))
+	for fileName := range index.Files {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+
+	var body bytes.Buffer
+	for _, fileName := range fileNames {
+		file, err := protojson.Marshal(index.Files[fileName])
+		if err != nil {
+			return err
+		}
+		line, err := json.Marshal(indexEntry{File: file, Stat: index.Stats[fileName]})
+		if err != nil {
+			return err
+		}
+		body.Write(line)
+		body.WriteByte('\n')
+	}
+
+	headerLine, err := json.Marshal(indexHeader{
+		Format:     INDEX_FORMAT_NAME,
+		Version:    INDEX_FORMAT_VERSION,
+		Epoch:      index.Epoch,
+		LastSeq:    index.LastSeq,
+		Selection:  index.Selection,
+		IgnoreHash: index.IgnoreHash,
+		Entries:    len(fileNames),
+		Checksum:   GetBlockHashString(body.Bytes()),
+	})
+	if err != nil {
+		return err
+	}
+
+	content := append(append(headerLine, '\n'), body.Bytes()...)
+	if err := writeFileAtomic(ConcatPath(baseDir, DEFAULT_META_FILENAME), content); err != nil {
+		return fmt.Errorf("writing index: %w", err)
+	}
+
+	// the sequence number of a migrated index now lives in its header
+	if err := os.Remove(ConcatPath(baseDir, DEFAULT_SEQ_FILENAME)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// writeFileAtomic writes content to a temporary file, flushes it to disk
+// and renames it to path, so readers see either the old or the new file
+func writeFileAtomic(path string, content []byte) error {
+	return writeAtomic(path, path+TEMP_FILE_SUFFIX, 0644, func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+}
+
+// writeAtomic lets write fill tempPath, flushes it to disk and renames it
+// to path. A stale temporary file is replaced rather than written through,
+// and the temporary file is removed if anything fails.
+func writeAtomic(path string, tempPath string, perm fs.FileMode, write func(w io.Writer) error) error {
+	if err := os.Remove(tempPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	tempFD, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if err := write(tempFD); err != nil {
+		tempFD.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	if err := tempFD.Sync(); err != nil {
+		tempFD.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	if err := tempFD.Close(); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	// persist the rename itself
+	if dirFD, err := os.Open(filepath.Dir(path)); err == nil {
+		dirFD.Sync()
+		dirFD.Close()
+	}
+	return nil
+}
+
+// loadLegacyIndex parses the comma- and space-delimited index written by
+// older clients, along with the sequence number they kept in index.seq
+func loadLegacyIndex(baseDir string, content []byte) (*LocalIndex, error) {
+	index := &LocalIndex{Files: make(map[string]*FileMetaData), Stats: make(map[string]*FileStat)}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		if strings.Count(line, CONFIG_DELIMITER) != HASH_LIST_INDEX {
+			return nil, fmt.Errorf("malformed legacy index line %q", line)
+		}
+		fileMeta := NewFileMetaDataFromConfig(line)
+		normalizeTombstone(fileMeta)
+		index.Files[fileMeta.Filename] = fileMeta
+	}
+
+	seqContent, err := os.ReadFile(ConcatPath(baseDir, DEFAULT_SEQ_FILENAME))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if fields := strings.Fields(string(seqContent)); len(fields) == 2 {
+		if seq, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			index.Epoch, index.LastSeq = fields[0], seq
+		}
+	}
+
+	return index, nil
+}
+
 // NewFileMetaDataFromConfig returns a FileMetaData struct
-// associated with one line in the local metadata file.
+// associated with one line in the legacy local metadata file.
 func NewFileMetaDataFromConfig(configString string) *FileMetaData {
 	configItems := strings.Split(configString, CONFIG_DELIMITER)
 
@@ -54,48 +389,15 @@ func NewFileMetaDataFromConfig(configString string) *FileMetaData {
 // The key is the file's name and the value is the file's metadata.
 // You can use this function to load the index.txt file in this project.
 func LoadMetaFromMetaFile(baseDir string) (fileMetaMap map[string]*FileMetaData, e error) {
-	metaFilePath, _ := filepath.Abs(ConcatPath(baseDir, DEFAULT_META_FILENAME))
-
-	fileMetaMap = make(map[string]*FileMetaData)
-
-	metaFileStats, e := os.Stat(metaFilePath)
-	if e != nil || metaFileStats.IsDir() {
-		return fileMetaMap, nil
-	}
-	metaFD, e := os.Open(metaFilePath)
+	index, e := LoadLocalIndex(baseDir)
 	if e != nil {
-		log.Fatal("Error When Opening Meta")
-	}
-	defer metaFD.Close()
-
-	leftOverContent := ""
-	metaReader := bufio.NewReader(metaFD)
-	for {
-		lineContent, isPrefix, e := metaReader.ReadLine()
-		if e != nil && e != io.EOF {
-			log.Fatal("Error During Reading Meta")
-		}
-
-		leftOverContent += string(lineContent)
-		if isPrefix {
-			continue
-		}
-
-		if len(leftOverContent) == 0 {
-			break
-		}
-
-		currFileMeta := NewFileMetaDataFromConfig(leftOverContent)
-
-		leftOverContent = ""
-		fileMetaMap[currFileMeta.Filename] = currFileMeta
+		return nil, e
 	}
-
-	return fileMetaMap, nil
+	return index.Files, nil
 }
 
-// FileMetaDataToString converts a FileMetaData struct
-// to a string for writing back to local metadata file
+// FileMetaDataToString converts a FileMetaData struct to
+// a line of the legacy local metadata file
 func FileMetaDataToString(fm *FileMetaData) (result string) {
 	result += fm.Filename + ","
 	result += strconv.Itoa(int(fm.Version)) + ","
@@ -108,22 +410,26 @@ func FileMetaDataToString(fm *FileMetaData) (result string) {
 	return
 }
 
-// WriteMetaFile writes the file meta map back to local metadata file
+// WriteMetaFile writes the file meta map back to local metadata file.
+// The index is written without a sequence number, so the next sync
+// fetches the full FileInfoMap.
 func WriteMetaFile(fileMetas map[string]*FileMetaData, baseDir string) error {
-	outputMetaPath := ConcatPath(baseDir, DEFAULT_META_FILENAME)
+	index := &LocalIndex{Files: fileMetas}
+	return index.Write(baseDir)
+}
 
-	outFD, err := os.Create(outputMetaPath)
-	if err != nil {
-		log.Fatal("Error During Meta Write Back")
+// MissingBlocks returns the block hashes an UpdateFile was rejected for
+// because the BlockStore does not have them, or nil for any other error
+func MissingBlocks(err error) []string {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.FailedPrecondition {
+		return nil
 	}
-
-	for _, fileMeta := range fileMetas {
-		_, err := outFD.WriteString(FileMetaDataToString(fileMeta))
-		if err != nil {
-			log.Fatal("Error During Meta Write Back")
+	for _, detail := range st.Details() {
+		if missing, ok := detail.(*BlockHashes); ok {
+			return missing.Hashes
 		}
 	}
-
 	return nil
 }
 
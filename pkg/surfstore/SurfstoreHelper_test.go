@@ -0,0 +1,95 @@
+package surfstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadLocalIndexMigratesLegacyIndex(t *testing.T) {
+	tests := []struct {
+		name      string
+		legacy    string
+		seq       string
+		wantFiles map[string]*FileMetaData
+		wantEpoch string
+		wantSeq   int64
+		wantErr   bool
+	}{
+		{
+			name:      "files",
+			legacy:    "a,3,h1 h2 \nb,1,h3 \n",
+			wantFiles: map[string]*FileMetaData{"a": {Filename: "a", Version: 3, BlockHashList: []string{"h1", "h2"}}, "b": {Filename: "b", Version: 1, BlockHashList: []string{"h3"}}},
+		},
+		{
+			name:      "tombstone",
+			legacy:    "a,2,0 \n",
+			wantFiles: map[string]*FileMetaData{"a": {Filename: "a", Version: 2, Deleted: true}},
+		},
+		{
+			name:      "sequence number",
+			legacy:    "a,1,h1 \n",
+			seq:       "epoch 7\n",
+			wantFiles: map[string]*FileMetaData{"a": {Filename: "a", Version: 1, BlockHashList: []string{"h1"}}},
+			wantEpoch: "epoch",
+			wantSeq:   7,
+		},
+		{
+			name:      "file name starting with a brace",
+			legacy:    "{a},1,h1 \n",
+			wantFiles: map[string]*FileMetaData{"{a}": {Filename: "{a}", Version: 1, BlockHashList: []string{"h1"}}},
+		},
+		{
+			name:    "malformed line",
+			legacy:  "a,1\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, DEFAULT_META_FILENAME), []byte(tt.legacy), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if tt.seq != "" {
+			if err := os.WriteFile(filepath.Join(dir, DEFAULT_SEQ_FILENAME), []byte(tt.seq), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		index, err := LoadLocalIndex(dir)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: loading %q succeeded, want an error", tt.name, tt.legacy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(index.Files, tt.wantFiles) || index.Epoch != tt.wantEpoch || index.LastSeq != tt.wantSeq {
+			t.Errorf("%s: loaded %v at %q/%d, want %v at %q/%d", tt.name, index.Files, index.Epoch, index.LastSeq, tt.wantFiles, tt.wantEpoch, tt.wantSeq)
+		}
+
+		// writing the index back migrates it to the current format
+		if err := index.Write(dir); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, DEFAULT_SEQ_FILENAME)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s: the legacy sequence file is still there: %v", tt.name, err)
+		}
+		migrated, err := LoadLocalIndex(dir)
+		if err != nil {
+			t.Fatalf("%s: loading the migrated index: %v", tt.name, err)
+		}
+		if len(migrated.Files) != len(tt.wantFiles) || migrated.Epoch != tt.wantEpoch || migrated.LastSeq != tt.wantSeq {
+			t.Errorf("%s: migrated index has %v at %q/%d, want %v at %q/%d", tt.name, migrated.Files, migrated.Epoch, migrated.LastSeq, tt.wantFiles, tt.wantEpoch, tt.wantSeq)
+		}
+		for fileName, want := range tt.wantFiles {
+			if got := migrated.Files[fileName]; got == nil || got.Version != want.Version || got.Deleted != want.Deleted || !reflect.DeepEqual(got.BlockHashList, want.BlockHashList) {
+				t.Errorf("%s: migrated %s is %v, want %v", tt.name, fileName, got, want)
+			}
+		}
+	}
+}
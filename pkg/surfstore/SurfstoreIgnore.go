@@ -0,0 +1,184 @@
+package surfstore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ignoreRule is one pattern of a .surfignore file
+type ignoreRule struct {
+	pattern *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// IgnoreMatcher decides which paths ClientSync leaves out, following the
+// semantics of .gitignore: blank lines and lines starting with # are
+// skipped, ! re-includes a path, a trailing / only matches directories, a
+// pattern containing / is relative to the base directory and any other
+// pattern matches at every level. *, ? and [...] match within one path
+// component and ** matches across components. The last matching rule wins,
+// and nothing inside an ignored directory can be re-included.
+type IgnoreMatcher struct {
+	rules []ignoreRule
+	// the pattern lines the rules were made from, in order
+	lines []string
+}
+
+// LoadIgnoreMatcher reads the .surfignore file of the base directory, if
+// any, and appends the extra patterns
+func LoadIgnoreMatcher(baseDir string, extra []string) (*IgnoreMatcher, error) {
+	m := &IgnoreMatcher{}
+
+	ignoreFD, err := os.Open(ConcatPath(baseDir, IGNORE_FILENAME))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		defer ignoreFD.Close()
+		scanner := bufio.NewScanner(ignoreFD)
+		for lineNo := 1; scanner.Scan(); lineNo++ {
+			if err := m.Add(scanner.Text()); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", IGNORE_FILENAME, lineNo, err)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, pattern := range extra {
+		if err := m.Add(pattern); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Add appends one pattern line, or fails if the pattern is malformed, e.g.
+// has a character class like [z-a]
+func (m *IgnoreMatcher) Add(line string) error {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	raw := line
+
+	rule := ignoreRule{}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return nil
+	}
+
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	expr := globToRegexp(line)
+	if anchored {
+		expr = "^" + expr + "$"
+	} else {
+		expr = "^(?:.*/)?" + expr + "$"
+	}
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("invalid ignore pattern %q: %v", raw, err)
+	}
+	rule.pattern = pattern
+	m.rules = append(m.rules, rule)
+	m.lines = append(m.lines, raw)
+	return nil
+}
+
+// Hash identifies the patterns, so a client can tell when they changed.
+// No patterns hash to the empty string.
+func (m *IgnoreMatcher) Hash() string {
+	if m == nil || len(m.lines) == 0 {
+		return ""
+	}
+	return GetBlockHashString([]byte(strings.Join(m.lines, "\n")))
+}
+
+// Match reports whether a slash-separated path relative to the base
+// directory is ignored
+func (m *IgnoreMatcher) Match(path string, isDir bool) bool {
+	if m == nil || len(m.rules) == 0 {
+		return false
+	}
+
+	// an ignored parent directory hides everything below it
+	for i := 0; i < len(path); i++ {
+		if path[i] == '/' && m.matchRules(path[:i], true) {
+			return true
+		}
+	}
+	return m.matchRules(path, isDir)
+}
+
+func (m *IgnoreMatcher) matchRules(path string, isDir bool) bool {
+	ignored := false
+	for _, rule := range m.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.pattern.MatchString(path) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// globToRegexp translates a gitignore glob into a regular expression
+func globToRegexp(glob string) string {
+	var expr strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case c == '*' && strings.HasPrefix(glob[i:], "**/"):
+			// zero or more leading directories
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case c == '/' && glob[i:] == "/**":
+			// everything inside a directory
+			expr.WriteString("/.*")
+			i += 2
+		case c == '*' && strings.HasPrefix(glob[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				expr.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			expr.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return expr.String()
+}
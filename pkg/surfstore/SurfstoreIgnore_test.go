@@ -0,0 +1,94 @@
+package surfstore
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob string
+		want string
+	}{
+		{"*.swp", `[^/]*\.swp`},
+		{"file?.txt", `file[^/]\.txt`},
+		{"**/build", `(?:.*/)?build`},
+		{"logs/**", `logs/.*`},
+		{"a/**/b", `a/(?:.*/)?b`},
+		{"a**b", `a.*b`},
+		{"[abc].go", `[abc]\.go`},
+		{"[!abc].go", `[^abc]\.go`},
+		{"[unclosed", `\[unclosed`},
+		{`\*literal`, `\*literal`},
+	}
+	for _, tt := range tests {
+		if got := globToRegexp(tt.glob); got != tt.want {
+			t.Errorf("globToRegexp(%q) = %q, want %q", tt.glob, got, tt.want)
+		}
+	}
+}
+
+func TestIgnoreMatcher(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		{"unanchored matches at every level", []string{"*.swp"}, "a/b/c.swp", false, true},
+		{"star does not cross components", []string{"a*c"}, "ab/c", false, false},
+		{"anchored matches from the base", []string{"/build"}, "build", true, true},
+		{"anchored does not match deeper", []string{"/build"}, "src/build", true, false},
+		{"slash in the middle anchors", []string{"docs/*.md"}, "x/docs/a.md", false, false},
+		{"slash in the middle matches", []string{"docs/*.md"}, "docs/a.md", false, true},
+		{"double star leading", []string{"**/tmp"}, "a/b/tmp", true, true},
+		{"double star trailing", []string{"logs/**"}, "logs/a/b.log", false, true},
+		{"double star in the middle", []string{"a/**/z"}, "a/b/c/z", false, true},
+		{"double star matches zero directories", []string{"a/**/z"}, "a/z", false, true},
+		{"trailing slash matches directories", []string{"build/"}, "build", true, true},
+		{"trailing slash skips files", []string{"build/"}, "build", false, false},
+		{"trailing slash hides contents", []string{"build/"}, "build/out.o", false, true},
+		{"negation re-includes", []string{"*.log", "!keep.log"}, "keep.log", false, false},
+		{"last rule wins", []string{"!keep.log", "*.log"}, "keep.log", false, true},
+		{"negation cannot escape an ignored directory", []string{"build/", "!build/keep"}, "build/keep", false, true},
+		{"escaped negation is literal", []string{`\!important`}, "!important", false, true},
+		{"comments and blank lines", []string{"# *.go", ""}, "main.go", false, false},
+		{"character class", []string{"[ab].txt"}, "b.txt", false, true},
+		{"negated character class", []string{"[!ab].txt"}, "b.txt", false, false},
+	}
+	for _, tt := range tests {
+		m := &IgnoreMatcher{}
+		for _, pattern := range tt.patterns {
+			if err := m.Add(pattern); err != nil {
+				t.Fatalf("%s: Add(%q): %v", tt.name, pattern, err)
+			}
+		}
+		if got := m.Match(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("%s: Match(%q, %v) = %v, want %v", tt.name, tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestIgnoreMatcherBadClass(t *testing.T) {
+	for _, pattern := range []string{"[z-a]", "x[]", "/[b-a]/"} {
+		m := &IgnoreMatcher{}
+		if err := m.Add(pattern); err == nil {
+			t.Errorf("Add(%q) succeeded, want an error", pattern)
+		}
+	}
+}
+
+func TestLoadIgnoreMatcherBadClass(t *testing.T) {
+	baseDir := t.TempDir()
+	if err := os.WriteFile(ConcatPath(baseDir, IGNORE_FILENAME), []byte("*.swp\n[z-a]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadIgnoreMatcher(baseDir, nil); err == nil || !strings.Contains(err.Error(), IGNORE_FILENAME+":2") {
+		t.Errorf("LoadIgnoreMatcher = %v, want an error on line 2", err)
+	}
+	if _, err := LoadIgnoreMatcher(t.TempDir(), []string{"[z-a]"}); err == nil {
+		t.Error("LoadIgnoreMatcher with a bad -exclude succeeded, want an error")
+	}
+}
@@ -10,11 +10,41 @@ type MetaStoreInterface interface {
 	// Retrieves the server's FileInfoMap
 	GetFileInfoMap(ctx context.Context, _ *emptypb.Empty) (*FileInfoMap, error)
 
+	// Retrieve one page of the files under a prefix
+	ListFiles(ctx context.Context, req *ListFilesRequest) (*ListFilesResponse, error)
+
 	// Update a file's fileinfo entry
 	UpdateFile(ctx context.Context, fileMetaData *FileMetaData) (*Version, error)
 
+	// Update the fileinfo entries of several files at once, all or nothing
+	UpdateFiles(ctx context.Context, batch *FileInfoMap) (*FileInfoMap, error)
+
 	// Get the the BlockStore address
 	GetBlockStoreAddr(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddr, error)
+
+	// Get the default and allowed range of block sizes
+	GetBlockSizeRange(ctx context.Context, _ *emptypb.Empty) (*BlockSizeRange, error)
+
+	// Give a principal access to a file or directory
+	GrantAccess(ctx context.Context, req *AccessRequest) (*Success, error)
+
+	// Remove a principal's access to a file or directory
+	RevokeAccess(ctx context.Context, req *AccessRequest) (*Success, error)
+
+	// Report the logical bytes used by a user and a namespace
+	GetUsage(ctx context.Context, req *UsageRequest) (*UsageReport, error)
+
+	// Retrieve the files changed after a sequence number
+	GetChangesSince(ctx context.Context, req *ChangeRequest) (*ChangeList, error)
+
+	// Stream the files changed after a sequence number as they commit
+	WatchFiles(req *ChangeRequest, stream MetaStore_WatchFilesServer) error
+
+	// Move a file to a new name, leaving a tombstone behind
+	RenameFile(ctx context.Context, req *RenameRequest) (*FileInfoMap, error)
+
+	// Restore a deleted file whose tombstone has not been purged
+	UndeleteFile(ctx context.Context, req *UndeleteRequest) (*Version, error)
 }
 
 type BlockStoreInterface interface {
@@ -28,16 +58,34 @@ type BlockStoreInterface interface {
 	// Given a list of hashes “in”, returns a list containing the
 	// subset of in that are stored in the key-value store
 	HasBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockHashes, error)
+
+	// Report the physical bytes used by a user and a namespace
+	GetUsage(ctx context.Context, req *UsageRequest) (*UsageReport, error)
+
+	// Replace the attribution of blocks with that of the committed files
+	AttributeBlocks(stream BlockStore_AttributeBlocksServer) error
 }
 
+// ClientInterface methods take the caller's context, which bounds the call
+// including any retries
 type ClientInterface interface {
 	// MetaStore
-	GetFileInfoMap(serverFileInfoMap *map[string]*FileMetaData) error
-	UpdateFile(fileMetaData *FileMetaData, latestVersion *int32) error
-	GetBlockStoreAddr(blockStoreAddr *string) error
+	GetFileInfoMap(ctx context.Context, serverFileInfoMap *map[string]*FileMetaData) error
+	ListFiles(ctx context.Context, prefix string, pageSize int32, pageToken string, files *[]*FileMetaData, nextPageToken *string) error
+	GetChangesSince(ctx context.Context, epoch string, sinceSeq int64, changes *ChangeList) error
+	WatchFiles(ctx context.Context, epoch string, sinceSeq int64, onChange func(*ChangeList) error) error
+	UpdateFile(ctx context.Context, fileMetaData *FileMetaData, latestVersion *int32) error
+	UpdateFiles(ctx context.Context, batch []*FileMetaData, fileInfoMap *map[string]*FileMetaData) error
+	RenameFile(ctx context.Context, from string, fromVersion int32, to *FileMetaData, fileInfoMap *map[string]*FileMetaData) error
+	UndeleteFile(ctx context.Context, fileName string, latestVersion *int32) error
+	GetBlockStoreAddr(ctx context.Context, blockStoreAddr *string) error
+	GetBlockSizeRange(ctx context.Context, blockSizes *BlockSizeRange) error
+	GrantAccess(ctx context.Context, path string, principal string, permission Permission) error
+	RevokeAccess(ctx context.Context, path string, principal string) error
+	GetUsage(ctx context.Context, user string, namespace string, blockStoreAddr string, report *UsageReport) error
 
 	// BlockStore
-	GetBlock(blockHash string, blockStoreAddr string, block *Block) error
-	PutBlock(block *Block, blockStoreAddr string, succ *bool) error
-	HasBlocks(blockHashesIn []string, blockStoreAddr string, blockHashesOut *[]string) error
+	GetBlock(ctx context.Context, blockHash string, blockStoreAddr string, block *Block) error
+	PutBlock(ctx context.Context, block *Block, namespace string, blockStoreAddr string, succ *bool) error
+	HasBlocks(ctx context.Context, blockHashesIn []string, blockStoreAddr string, blockHashesOut *[]string) error
 }
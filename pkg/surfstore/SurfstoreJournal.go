@@ -0,0 +1,76 @@
+package surfstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// uploadJournal lists the uploads a sync started. It is written before the
+// first block is put and removed once they all committed, so a sync that
+// was interrupted finds out which uploads to resume.
+type uploadJournal struct {
+	Uploads map[string]*journalEntry `json:"uploads"`
+}
+
+// journalEntry is the version and content a file was being uploaded with
+type journalEntry struct {
+	Version       int32    `json:"version"`
+	BlockHashList []string `json:"blockHashList"`
+}
+
+// loadUploadJournal reads the journal of the base directory. A missing
+// journal means the last sync finished.
+func loadUploadJournal(baseDir string) (*uploadJournal, error) {
+	journal := &uploadJournal{Uploads: make(map[string]*journalEntry)}
+
+	content, err := os.ReadFile(ConcatPath(baseDir, DEFAULT_JOURNAL_FILENAME))
+	if errors.Is(err, os.ErrNotExist) {
+		return journal, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading upload journal: %w", err)
+	}
+	if err := json.Unmarshal(content, journal); err != nil {
+		return nil, fmt.Errorf("reading upload journal: %w", err)
+	}
+	if journal.Uploads == nil {
+		journal.Uploads = make(map[string]*journalEntry)
+	}
+	return journal, nil
+}
+
+// add records that a file is about to be uploaded
+func (journal *uploadJournal) add(meta *FileMetaData) {
+	journal.Uploads[meta.Filename] = &journalEntry{Version: meta.Version, BlockHashList: meta.BlockHashList}
+}
+
+// resumes reports whether an interrupted sync was uploading the same
+// version and content of the file, so some of its blocks may already be
+// stored. An entry for another version is stale, e.g. because the server
+// moved on in the meantime.
+func (journal *uploadJournal) resumes(meta *FileMetaData) bool {
+	entry, ok := journal.Uploads[meta.Filename]
+	return ok && entry.Version == meta.Version && sameHashes(&FileMetaData{BlockHashList: entry.BlockHashList}, meta)
+}
+
+// write atomically replaces the journal, or removes it when it is empty
+func (journal *uploadJournal) write(baseDir string) error {
+	journalPath := ConcatPath(baseDir, DEFAULT_JOURNAL_FILENAME)
+	if len(journal.Uploads) == 0 {
+		if err := os.Remove(journalPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("removing upload journal: %w", err)
+		}
+		return nil
+	}
+
+	content, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(journalPath, content); err != nil {
+		return fmt.Errorf("writing upload journal: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package surfstore
+
+import (
+	"sync"
+	"time"
+)
+
+// Progress is a snapshot of a running sync. Bytes count the blocks that
+// have to move; files whose blocks the other side already has count as
+// done in one step.
+type Progress struct {
+	FilesDone  int
+	FilesTotal int
+	BytesDone  int64
+	BytesTotal int64
+	// Current is the file being transferred
+	Current string
+	Elapsed time.Duration
+	// Throughput is in bytes per second, ETA is 0 while it is unknown
+	Throughput float64
+	ETA        time.Duration
+}
+
+// ProgressReporter is told about a sync's progress after every block and
+// every file. Calls come from the goroutine running ClientSync and should
+// return quickly.
+type ProgressReporter interface {
+	ReportProgress(p Progress)
+}
+
+// ProgressFunc adapts a function to a ProgressReporter
+type ProgressFunc func(p Progress)
+
+func (f ProgressFunc) ReportProgress(p Progress) {
+	f(p)
+}
+
+// progressTracker turns the block transfers of ClientSync into Progress
+// snapshots. A nil tracker reports nothing.
+type progressTracker struct {
+	reporter ProgressReporter
+	start    time.Time
+
+	mu          sync.Mutex
+	progress    Progress
+	settled     int64 // planned bytes of the files that are done
+	current     int64 // bytes of the current file so far
+	transferred int64 // bytes actually sent or received
+}
+
+func newProgressTracker(reporter ProgressReporter, plan *syncPlan) *progressTracker {
+	if reporter == nil {
+		return nil
+	}
+	t := &progressTracker{reporter: reporter, start: time.Now()}
+	for _, planned := range plan.uploads {
+		t.progress.FilesTotal++
+		t.progress.BytesTotal += plannedBytes(planned)
+	}
+	for _, planned := range plan.downloads {
+		t.progress.FilesTotal++
+		t.progress.BytesTotal += plannedBytes(planned)
+	}
+	t.report()
+	return t
+}
+
+// plannedBytes is how many block bytes an action may transfer
+func plannedBytes(planned plannedAction) int64 {
+	switch planned.action {
+	case ACTION_UPLOAD:
+		if planned.metadataOnly || planned.local.SymlinkTarget != "" {
+			return 0
+		}
+		return planned.local.Size
+	case ACTION_DOWNLOAD, ACTION_CONFLICT:
+		if isTombstone(planned.remote) || planned.remote.SymlinkTarget != "" {
+			return 0
+		}
+		return planned.remote.Size
+	}
+	return 0
+}
+
+// startFile marks the file whose blocks come next
+func (t *progressTracker) startFile(fileName string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.progress.Current = fileName
+	t.current = 0
+	t.mu.Unlock()
+	t.report()
+}
+
+// block records bytes of the current file that were transferred
+func (t *progressTracker) block(bytes int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.current += int64(bytes)
+	t.transferred += int64(bytes)
+	t.mu.Unlock()
+	t.report()
+}
+
+// fileDone settles the planned bytes of a finished file, whether its blocks
+// were transferred, skipped or failed
+func (t *progressTracker) fileDone(planned plannedAction) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.progress.FilesDone++
+	t.progress.Current = ""
+	t.settled += plannedBytes(planned)
+	t.current = 0
+	t.mu.Unlock()
+	t.report()
+}
+
+func (t *progressTracker) report() {
+	t.mu.Lock()
+	p := t.progress
+	p.BytesDone = t.settled + t.current
+	if p.BytesDone > p.BytesTotal {
+		p.BytesDone = p.BytesTotal
+	}
+	p.Elapsed = time.Since(t.start)
+	if seconds := p.Elapsed.Seconds(); seconds > 0 && t.transferred > 0 {
+		p.Throughput = float64(t.transferred) / seconds
+		p.ETA = time.Duration(float64(p.BytesTotal-p.BytesDone) / p.Throughput * float64(time.Second))
+	}
+	t.mu.Unlock()
+	t.reporter.ReportProgress(p)
+}
@@ -2,10 +2,14 @@ package surfstore
 
 import (
 	context "context"
-	"time"
+	"crypto/sha256"
 
 	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
@@ -13,142 +17,494 @@ type RPCClient struct {
 	MetaStoreAddr string
 	BaseDir       string
 	BlockSize     int
+
+	// Token authenticates the client as its user, empty means anonymous
+	Token string
+
+	// BlockTreeThreshold is the number of blocks above which ClientSync
+	// stores a file's block list as a tree of index blocks, 0 means never
+	BlockTreeThreshold int
+
+	// Retry applies to calls that are safe to repeat, MutationRetry to
+	// calls that change metadata
+	Retry         RetryPolicy
+	MutationRetry RetryPolicy
+
+	// UploadLimit and DownloadLimit pace the blocks ClientSync transfers,
+	// nil means unlimited
+	UploadLimit   *RateLimiter
+	DownloadLimit *RateLimiter
 }
 
-func (surfClient *RPCClient) GetBlock(blockHash string, blockStoreAddr string, block *Block) error {
-	// connect to the server
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
-	if err != nil {
-		return err
+// outgoingContext returns the context of one attempt, which carries the
+// client's token and any extra metadata key-value pairs
+func (surfClient *RPCClient) outgoingContext(ctx context.Context, kv ...string) context.Context {
+	if surfClient.Token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, AUTH_METADATA_KEY, AUTH_SCHEME+surfClient.Token)
 	}
-	c := NewBlockStoreClient(conn)
-
-	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	b, err := c.GetBlock(ctx, &BlockHash{Hash: blockHash})
-	if err != nil {
-		conn.Close()
-		return err
+	if len(kv) > 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, kv...)
 	}
-	block.BlockData = b.BlockData
-	block.BlockSize = b.BlockSize
+	return ctx
+}
 
-	// close the connection
-	return conn.Close()
+func (surfClient *RPCClient) GetBlock(ctx context.Context, blockHash string, blockStoreAddr string, block *Block) error {
+	return surfClient.Retry.sized(int(MAX_BLOCK_SIZE)).do(ctx, func(ctx context.Context) error {
+		// connect to the server
+		conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+		if err != nil {
+			return err
+		}
+		c := NewBlockStoreClient(conn)
+
+		// perform the call
+		b, err := c.GetBlock(surfClient.outgoingContext(ctx), &BlockHash{Hash: blockHash})
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		block.BlockData = b.BlockData
+		block.BlockSize = b.BlockSize
+
+		// close the connection
+		return conn.Close()
+	})
 }
 
-func (surfClient *RPCClient) PutBlock(block *Block, blockStoreAddr string, succ *bool) error {
-	//panic("todo")
-	//connect to the server
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
-	if err != nil {
-		return err
-	}
-	c := NewBlockStoreClient(conn)
+func (surfClient *RPCClient) PutBlock(ctx context.Context, block *Block, namespace string, blockStoreAddr string, succ *bool) error {
+	// storing the same block twice is harmless
+	return surfClient.Retry.sized(len(block.BlockData)).do(ctx, func(ctx context.Context) error {
+		//connect to the server
+		conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+		if err != nil {
+			return err
+		}
+		c := NewBlockStoreClient(conn)
 
-	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	s, err := c.PutBlock(ctx, block)
-	if err != nil {
-		conn.Close()
-		return err
-	}
-	*succ = s.Flag
+		// perform the call
+		s, err := c.PutBlock(surfClient.outgoingContext(ctx, NAMESPACE_METADATA_KEY, namespace), block)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		*succ = s.Flag
 
-	// close the connection
-	return conn.Close()
+		// close the connection
+		return conn.Close()
+	})
 }
 
-func (surfClient *RPCClient) HasBlocks(blockHashesIn []string, blockStoreAddr string, blockHashesOut *[]string) error {
-	//panic("todo")
-	// connect to the server
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
-	if err != nil {
-		return err
-	}
-	c := NewBlockStoreClient(conn)
-	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	b, err := c.HasBlocks(ctx, &BlockHashes{Hashes: blockHashesIn})
-	if err != nil {
-		conn.Close()
-		return err
-	}
-	*blockHashesOut = b.Hashes
+func (surfClient *RPCClient) HasBlocks(ctx context.Context, blockHashesIn []string, blockStoreAddr string, blockHashesOut *[]string) error {
+	return surfClient.Retry.sized(len(blockHashesIn)*(sha256.Size*2+2)).do(ctx, func(ctx context.Context) error {
+		// connect to the server
+		conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+		if err != nil {
+			return err
+		}
+		c := NewBlockStoreClient(conn)
+		// perform the call
+		b, err := c.HasBlocks(surfClient.outgoingContext(ctx), &BlockHashes{Hashes: blockHashesIn})
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		*blockHashesOut = b.Hashes
+
+		// close the connection
+		return conn.Close()
+	})
+}
+
+func (surfClient *RPCClient) GetFileInfoMap(ctx context.Context, serverFileInfoMap *map[string]*FileMetaData) error {
+	return surfClient.Retry.do(ctx, func(ctx context.Context) error {
+		// connect to the server
+		conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return err
+		}
+		c := NewMetaStoreClient(conn)
+
+		// perform the call
+		f, err := c.GetFileInfoMap(surfClient.outgoingContext(ctx), &emptypb.Empty{})
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		*serverFileInfoMap = f.FileInfoMap
+		// close the connection
+		return conn.Close()
+	})
+}
 
-	// close the connection
-	return conn.Close()
+// ListFiles returns one page of the files whose names start with prefix.
+// An empty nextPageToken means it was the last page.
+func (surfClient *RPCClient) ListFiles(ctx context.Context, prefix string, pageSize int32, pageToken string, files *[]*FileMetaData, nextPageToken *string) error {
+	return surfClient.Retry.sized(MAX_LIST_PAGE_BYTES).do(ctx, func(ctx context.Context) error {
+		// connect to the server
+		conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return err
+		}
+		c := NewMetaStoreClient(conn)
+
+		// perform the call
+		page, err := c.ListFiles(surfClient.outgoingContext(ctx), &ListFilesRequest{Prefix: prefix, PageSize: pageSize, PageToken: pageToken})
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		*files = page.Files
+		*nextPageToken = page.NextPageToken
+
+		// close the connection
+		return conn.Close()
+	})
+}
+
+// GetChangesSince returns the files changed after sinceSeq. When the server
+// cannot tell, the list is Full but empty, and the files have to be paged
+// through with ListFiles.
+func (surfClient *RPCClient) GetChangesSince(ctx context.Context, epoch string, sinceSeq int64, changes *ChangeList) error {
+	return surfClient.Retry.sized(MAX_LIST_PAGE_BYTES).do(ctx, func(ctx context.Context) error {
+		// connect to the server
+		conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return err
+		}
+		c := NewMetaStoreClient(conn)
+
+		// perform the call
+		cl, err := c.GetChangesSince(surfClient.outgoingContext(ctx), &ChangeRequest{Epoch: epoch, SinceSeq: sinceSeq, OmitFullListing: true})
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		changes.Epoch = cl.Epoch
+		changes.LatestSeq = cl.LatestSeq
+		changes.Full = cl.Full
+		changes.Files = cl.Files
+
+		// close the connection
+		return conn.Close()
+	})
 }
 
-func (surfClient *RPCClient) GetFileInfoMap(serverFileInfoMap *map[string]*FileMetaData) error {
-	//panic("todo")
+// WatchFiles calls onChange with every batch of changes the MetaStore pushes
+// after sinceSeq. It blocks until ctx is done, the stream fails or onChange
+// returns an error. It is not retried, callers reopen the stream.
+func (surfClient *RPCClient) WatchFiles(ctx context.Context, epoch string, sinceSeq int64, onChange func(*ChangeList) error) error {
 	// connect to the server
 	conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
 	c := NewMetaStoreClient(conn)
 
-	// connect to the server
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	// open the stream, it lives until the caller cancels ctx
+	ctx, cancel := context.WithCancel(surfClient.outgoingContext(ctx))
 	defer cancel()
-	f, err := c.GetFileInfoMap(ctx, &emptypb.Empty{})
+	stream, err := c.WatchFiles(ctx, &ChangeRequest{Epoch: epoch, SinceSeq: sinceSeq, OmitFullListing: true})
 	if err != nil {
-		conn.Close()
 		return err
 	}
-	*serverFileInfoMap = f.FileInfoMap
-	// close the connection
-	return conn.Close()
+
+	for {
+		changes, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if err := onChange(changes); err != nil {
+			return err
+		}
+	}
 }
 
-func (surfClient *RPCClient) UpdateFile(fileMetaData *FileMetaData, latestVersion *int32) error {
-	//panic("todo")
-	// connect to the server
-	conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		return err
+func (surfClient *RPCClient) UpdateFile(ctx context.Context, fileMetaData *FileMetaData, latestVersion *int32) error {
+	retried := false
+	return surfClient.MutationRetry.sized(proto.Size(fileMetaData)).do(ctx, func(ctx context.Context) error {
+		// connect to the server
+		conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return err
+		}
+		c := NewMetaStoreClient(conn)
+
+		// perform the call
+		v, err := c.UpdateFile(surfClient.outgoingContext(ctx), fileMetaData)
+		if err != nil && retried && isVersionError(err) {
+			if stored := surfClient.committedMetaData(ctx, c, fileMetaData); stored != nil {
+				v, err = &Version{Version: stored.Version}, nil
+			}
+		}
+		retried = true
+
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		*latestVersion = v.Version
+		// close the connection
+		return conn.Close()
+	})
+}
+
+// UpdateFiles commits a batch of files atomically and returns their
+// committed metadata
+func (surfClient *RPCClient) UpdateFiles(ctx context.Context, batch []*FileMetaData, fileInfoMap *map[string]*FileMetaData) error {
+	size := 0
+	for _, meta := range batch {
+		size += proto.Size(meta)
 	}
-	c := NewMetaStoreClient(conn)
+	retried := false
+	return surfClient.MutationRetry.sized(size).do(ctx, func(ctx context.Context) error {
+		conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return err
+		}
+		c := NewMetaStoreClient(conn)
 
-	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	v, err := c.UpdateFile(ctx, fileMetaData)
+		req := &FileInfoMap{FileInfoMap: make(map[string]*FileMetaData)}
+		for _, meta := range batch {
+			req.FileInfoMap[meta.Filename] = meta
+		}
+		committed, err := c.UpdateFiles(surfClient.outgoingContext(ctx), req)
+		if err != nil && retried && isVersionError(err) {
+			// the whole batch committed, or the replay was rejected for another reason
+			replayed := &FileInfoMap{FileInfoMap: make(map[string]*FileMetaData)}
+			for _, meta := range batch {
+				stored := surfClient.committedMetaData(ctx, c, meta)
+				if stored == nil {
+					replayed = nil
+					break
+				}
+				replayed.FileInfoMap[meta.Filename] = stored
+			}
+			if replayed != nil {
+				committed, err = replayed, nil
+			}
+		}
+		retried = true
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		*fileInfoMap = committed.FileInfoMap
+		return conn.Close()
+	})
+}
 
-	if err != nil {
-		conn.Close()
-		return err
+func (surfClient *RPCClient) RenameFile(ctx context.Context, from string, fromVersion int32, to *FileMetaData, fileInfoMap *map[string]*FileMetaData) error {
+	retried := false
+	return surfClient.MutationRetry.sized(proto.Size(to)).do(ctx, func(ctx context.Context) error {
+		conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return err
+		}
+		c := NewMetaStoreClient(conn)
+
+		renamed, err := c.RenameFile(surfClient.outgoingContext(ctx), &RenameRequest{From: from, FromVersion: fromVersion, To: to})
+		if status.Code(err) == codes.NotFound && retried {
+			// a committed rename leaves no file to move, only its result
+			oldMeta := surfClient.storedMetaData(ctx, c, from)
+			newMeta := surfClient.storedMetaData(ctx, c, to.Filename)
+			if oldMeta != nil && oldMeta.Deleted && oldMeta.Version == fromVersion+1 &&
+				newMeta != nil && newMeta.RenamedFrom == from && !newMeta.Deleted && sameHashes(newMeta, to) {
+				renamed, err = &FileInfoMap{FileInfoMap: map[string]*FileMetaData{from: oldMeta, to.Filename: newMeta}}, nil
+			}
+		}
+		retried = true
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		*fileInfoMap = renamed.FileInfoMap
+		return conn.Close()
+	})
+}
+
+// UndeleteFile is not retried, since a replay of a restore that committed
+// cannot be told apart from a restore by someone else
+func (surfClient *RPCClient) UndeleteFile(ctx context.Context, fileName string, latestVersion *int32) error {
+	policy := surfClient.MutationRetry
+	policy.MaxAttempts = 1
+	return policy.do(ctx, func(ctx context.Context) error {
+		conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return err
+		}
+		c := NewMetaStoreClient(conn)
+
+		v, err := c.UndeleteFile(surfClient.outgoingContext(ctx), &UndeleteRequest{Filename: fileName})
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		*latestVersion = v.Version
+		return conn.Close()
+	})
+}
+
+// storedMetaData returns the MetaStore's metadata of a file, or nil if it
+// has none or cannot be asked
+func (surfClient *RPCClient) storedMetaData(ctx context.Context, c MetaStoreClient, fileName string) *FileMetaData {
+	// a file sorts first among the names it is a prefix of
+	page, err := c.ListFiles(surfClient.outgoingContext(ctx), &ListFilesRequest{Prefix: fileName, PageSize: 1})
+	if err != nil || len(page.Files) == 0 || page.Files[0].Filename != fileName {
+		return nil
 	}
-	*latestVersion = v.Version
-	// close the connection
-	return conn.Close()
+	return page.Files[0]
 }
 
-func (surfClient *RPCClient) GetBlockStoreAddr(blockStoreAddr *string) error {
-	//panic("todo")
-	// connect to the server
-	conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		return err
+// committedMetaData returns the MetaStore's metadata of a file if it holds
+// meta at its version, i.e. a replayed update was rejected because the
+// first attempt went through, and nil otherwise
+func (surfClient *RPCClient) committedMetaData(ctx context.Context, c MetaStoreClient, meta *FileMetaData) *FileMetaData {
+	stored := surfClient.storedMetaData(ctx, c, meta.Filename)
+	if stored == nil || stored.Version != meta.Version || !sameFile(stored, meta) {
+		return nil
 	}
-	c := NewMetaStoreClient(conn)
+	return stored
+}
 
-	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	addr, err := c.GetBlockStoreAddr(ctx, &emptypb.Empty{})
-	if err != nil {
+// isVersionError reports whether an update was rejected for its version
+func isVersionError(err error) bool {
+	return status.Code(err) == codes.FailedPrecondition && MissingBlocks(err) == nil
+}
+
+func (surfClient *RPCClient) GetBlockStoreAddr(ctx context.Context, blockStoreAddr *string) error {
+	return surfClient.Retry.do(ctx, func(ctx context.Context) error {
+		// connect to the server
+		conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return err
+		}
+		c := NewMetaStoreClient(conn)
+
+		// perform the call
+		addr, err := c.GetBlockStoreAddr(surfClient.outgoingContext(ctx), &emptypb.Empty{})
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		*blockStoreAddr = addr.Addr
+
+		// close the connection
+		return conn.Close()
+	})
+}
+
+func (surfClient *RPCClient) GetBlockSizeRange(ctx context.Context, blockSizes *BlockSizeRange) error {
+	return surfClient.Retry.do(ctx, func(ctx context.Context) error {
+		// connect to the server
+		conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return err
+		}
+		c := NewMetaStoreClient(conn)
+
+		// perform the call
+		r, err := c.GetBlockSizeRange(surfClient.outgoingContext(ctx), &emptypb.Empty{})
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		blockSizes.DefaultSize = r.DefaultSize
+		blockSizes.MinSize = r.MinSize
+		blockSizes.MaxSize = r.MaxSize
+
+		// close the connection
+		return conn.Close()
+	})
+}
+
+// GrantAccess overwrites the principal's permission, so repeating it is safe
+func (surfClient *RPCClient) GrantAccess(ctx context.Context, path string, principal string, permission Permission) error {
+	return surfClient.Retry.do(ctx, func(ctx context.Context) error {
+		// connect to the server
+		conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return err
+		}
+		c := NewMetaStoreClient(conn)
+
+		// perform the call
+		_, err = c.GrantAccess(surfClient.outgoingContext(ctx), &AccessRequest{Path: path, Principal: principal, Permission: permission})
+		if err != nil {
+			conn.Close()
+			return err
+		}
+
+		// close the connection
+		return conn.Close()
+	})
+}
+
+func (surfClient *RPCClient) RevokeAccess(ctx context.Context, path string, principal string) error {
+	return surfClient.Retry.do(ctx, func(ctx context.Context) error {
+		// connect to the server
+		conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return err
+		}
+		c := NewMetaStoreClient(conn)
+
+		// perform the call
+		_, err = c.RevokeAccess(surfClient.outgoingContext(ctx), &AccessRequest{Path: path, Principal: principal})
+		if err != nil {
+			conn.Close()
+			return err
+		}
+
+		// close the connection
+		return conn.Close()
+	})
+}
+
+// GetUsage combines the logical usage known to the MetaStore with the
+// physical usage known to the BlockStore
+func (surfClient *RPCClient) GetUsage(ctx context.Context, user string, namespace string, blockStoreAddr string, report *UsageReport) error {
+	return surfClient.Retry.do(ctx, func(ctx context.Context) error {
+		// connect to the server
+		conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return err
+		}
+		c := NewMetaStoreClient(conn)
+
+		// perform the call
+		ctx = surfClient.outgoingContext(ctx)
+		logical, err := c.GetUsage(ctx, &UsageRequest{User: user, Namespace: namespace})
 		conn.Close()
-		return err
-	}
-	*blockStoreAddr = addr.Addr
+		if err != nil {
+			return err
+		}
+
+		// connect to the block store
+		conn, err = grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+		if err != nil {
+			return err
+		}
+		b := NewBlockStoreClient(conn)
+
+		// perform the call
+		physical, err := b.GetUsage(ctx, &UsageRequest{User: user, Namespace: namespace})
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		report.User = logical.User
+		report.Namespace = logical.Namespace
+		report.UserUsage = logical.UserUsage
+		report.UserUsage.PhysicalBytes = physical.UserUsage.PhysicalBytes
+		report.UserUsage.PhysicalLimit = physical.UserUsage.PhysicalLimit
+		report.NamespaceUsage = logical.NamespaceUsage
+		report.NamespaceUsage.PhysicalBytes = physical.NamespaceUsage.PhysicalBytes
+		report.NamespaceUsage.PhysicalLimit = physical.NamespaceUsage.PhysicalLimit
 
-	// close the connection
-	return conn.Close()
+		// close the connection
+		return conn.Close()
+	})
 }
 
 // This line guarantees all method for RPCClient are implemented
@@ -161,5 +517,7 @@ func NewSurfstoreRPCClient(hostPort, baseDir string, blockSize int) RPCClient {
 		MetaStoreAddr: hostPort,
 		BaseDir:       baseDir,
 		BlockSize:     blockSize,
+		Retry:         DefaultRetryPolicy(),
+		MutationRetry: MutationRetryPolicy(),
 	}
 }
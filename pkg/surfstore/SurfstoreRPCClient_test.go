@@ -0,0 +1,71 @@
+package surfstore
+
+import (
+	"context"
+	"testing"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// commitThenFail commits the first call to method and then reports the
+// server as unavailable, as if the connection dropped before the reply
+func commitThenFail(method string) grpc.UnaryServerInterceptor {
+	failed := make(chan struct{}, 1)
+	failed <- struct{}{}
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		if info.FullMethod != method || err != nil {
+			return resp, err
+		}
+		select {
+		case <-failed:
+			return nil, status.Error(codes.Unavailable, "connection lost")
+		default:
+			return resp, err
+		}
+	}
+}
+
+func TestUpdateFileReplay(t *testing.T) {
+	ctx := context.Background()
+	addr, metaStore, _ := startTestServer(t, grpc.UnaryInterceptor(commitThenFail("/surfstore.MetaStore/UpdateFile")))
+	client := NewSurfstoreRPCClient(addr, t.TempDir(), 4096)
+	client.MutationRetry.InitialBackoff = 0
+
+	var version int32
+	if err := client.UpdateFile(ctx, &FileMetaData{Filename: "a", Version: 1, Deleted: true}, &version); err != nil {
+		t.Fatalf("UpdateFile: %v", err)
+	}
+	if version != 1 || metaStore.FileMetaMap["a"].Version != 1 {
+		t.Errorf("got version %d, stored %d, want both 1", version, metaStore.FileMetaMap["a"].Version)
+	}
+
+	// a rejected update is still an error after a retry
+	metaStore.FileMetaMap["a"].Version = 5
+	if err := client.UpdateFile(ctx, &FileMetaData{Filename: "a", Version: 2, Deleted: true}, &version); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("stale UpdateFile: got %v, want FailedPrecondition", err)
+	}
+}
+
+func TestUpdateFilesReplay(t *testing.T) {
+	ctx := context.Background()
+	addr, metaStore, _ := startTestServer(t, grpc.UnaryInterceptor(commitThenFail("/surfstore.MetaStore/UpdateFiles")))
+	client := NewSurfstoreRPCClient(addr, t.TempDir(), 4096)
+	client.MutationRetry.InitialBackoff = 0
+
+	batch := []*FileMetaData{
+		{Filename: "a", Version: 1, Deleted: true},
+		{Filename: "b", Version: 1, Deleted: true},
+	}
+	var committed map[string]*FileMetaData
+	if err := client.UpdateFiles(ctx, batch, &committed); err != nil {
+		t.Fatalf("UpdateFiles: %v", err)
+	}
+	for _, fileName := range []string{"a", "b"} {
+		if meta, ok := committed[fileName]; !ok || meta.Version != 1 || metaStore.FileMetaMap[fileName].Version != 1 {
+			t.Errorf("%s: committed %v, stored %v, want version 1 once", fileName, meta, metaStore.FileMetaMap[fileName])
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package surfstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// SyncAction is what ClientSync did, or tried to do, with a file
+type SyncAction string
+
+const (
+	ACTION_UPLOAD        SyncAction = "upload"
+	ACTION_DOWNLOAD      SyncAction = "download"
+	ACTION_RENAME        SyncAction = "rename"
+	ACTION_DELETE_LOCAL  SyncAction = "delete-local"
+	ACTION_DELETE_REMOTE SyncAction = "delete-remote"
+	ACTION_CONFLICT      SyncAction = "conflict"
+	ACTION_SKIP          SyncAction = "skip"
+)
+
+// The order actions are summarized in
+var SYNC_ACTIONS = []SyncAction{
+	ACTION_UPLOAD, ACTION_DOWNLOAD, ACTION_RENAME, ACTION_DELETE_LOCAL, ACTION_DELETE_REMOTE, ACTION_CONFLICT, ACTION_SKIP,
+}
+
+// Stages of ClientSync that fail the whole sync rather than one file
+const (
+	STAGE_SCAN   string = "scanning base directory"
+	STAGE_INDEX  string = "accessing local index"
+	STAGE_SERVER string = "contacting server"
+)
+
+// FileOutcome records one action on one file. Err is nil on success.
+// Conflicts are resolved in favour of the server's version. A rename
+// records the old name in RenamedFrom.
+type FileOutcome struct {
+	Filename    string
+	RenamedFrom string
+	Action      SyncAction
+	Bytes       int64
+	Duration    time.Duration
+	Err         error
+}
+
+// displayName is the file name, or both names of a rename
+func (o FileOutcome) displayName() string {
+	if o.RenamedFrom != "" {
+		return o.RenamedFrom + " -> " + o.Filename
+	}
+	return o.Filename
+}
+
+// SyncReport lists the outcome of every action ClientSync took. In a dry
+// run it lists the planned actions and the bytes they would transfer.
+type SyncReport struct {
+	DryRun    bool
+	StartedAt time.Time
+	Duration  time.Duration
+	Files     []FileOutcome
+}
+
+func newSyncReport() *SyncReport {
+	return &SyncReport{StartedAt: time.Now()}
+}
+
+func (r *SyncReport) add(filename string, action SyncAction, start time.Time, bytes int64, err error) {
+	r.Files = append(r.Files, FileOutcome{
+		Filename: filename,
+		Action:   action,
+		Bytes:    bytes,
+		Duration: time.Since(start),
+		Err:      err,
+	})
+}
+
+func (r *SyncReport) addRename(from string, to string, start time.Time, bytes int64, err error) {
+	r.add(to, ACTION_RENAME, start, bytes, err)
+	r.Files[len(r.Files)-1].RenamedFrom = from
+}
+
+// finish records the total duration and returns err
+func (r *SyncReport) finish(err error) (*SyncReport, error) {
+	r.Duration = time.Since(r.StartedAt)
+	return r, err
+}
+
+// Failed returns the outcomes of the actions that did not succeed. Skipped
+// files are not failures.
+func (r *SyncReport) Failed() []FileOutcome {
+	var failed []FileOutcome
+	for _, outcome := range r.Files {
+		if outcome.Err != nil && outcome.Action != ACTION_SKIP {
+			failed = append(failed, outcome)
+		}
+	}
+	return failed
+}
+
+// Skipped returns the outcomes of the files that could not be read, with
+// the reason in Err
+func (r *SyncReport) Skipped() []FileOutcome {
+	var skipped []FileOutcome
+	for _, outcome := range r.Files {
+		if outcome.Action == ACTION_SKIP {
+			skipped = append(skipped, outcome)
+		}
+	}
+	return skipped
+}
+
+// Total returns how many files an action was taken on, and their bytes
+func (r *SyncReport) Total(action SyncAction) (files int, bytes int64) {
+	for _, outcome := range r.Files {
+		if outcome.Action == action {
+			files++
+			bytes += outcome.Bytes
+		}
+	}
+	return files, bytes
+}
+
+// WriteTable prints the report as a human readable table with a summary
+func (r *SyncReport) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if len(r.Files) > 0 {
+		fmt.Fprintln(tw, "ACTION\tFILE\tBYTES\tTIME\tSTATUS")
+		for _, outcome := range r.Files {
+			status := "ok"
+			if r.DryRun {
+				status = "planned"
+			}
+			if outcome.Err != nil {
+				status = outcome.Err.Error()
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%v\t%s\n", outcome.Action, outcome.displayName(), outcome.Bytes,
+				outcome.Duration.Round(time.Millisecond), status)
+		}
+		fmt.Fprintln(tw)
+	}
+
+	var summary []string
+	for _, action := range SYNC_ACTIONS {
+		if files, bytes := r.Total(action); files > 0 {
+			summary = append(summary, fmt.Sprintf("%d %s (%d bytes)", files, action, bytes))
+		}
+	}
+	line := strings.Join(summary, ", ")
+	if len(summary) == 0 {
+		line = "nothing to sync"
+	} else if r.DryRun {
+		line = "dry run, would " + line
+	}
+	fmt.Fprintf(tw, "%s in %v, %d failed, %d skipped\n", line, r.Duration.Round(time.Millisecond), len(r.Failed()), len(r.Skipped()))
+	return tw.Flush()
+}
+
+type jsonOutcome struct {
+	Filename    string     `json:"filename"`
+	RenamedFrom string     `json:"renamedFrom,omitempty"`
+	Action      SyncAction `json:"action"`
+	Bytes       int64      `json:"bytes"`
+	DurationMs  int64      `json:"durationMs"`
+	Error       string     `json:"error,omitempty"`
+}
+
+type jsonTotal struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+type jsonReport struct {
+	DryRun     bool                      `json:"dryRun"`
+	StartedAt  time.Time                 `json:"startedAt"`
+	DurationMs int64                     `json:"durationMs"`
+	Failed     int                       `json:"failed"`
+	Skipped    int                       `json:"skipped"`
+	Totals     map[SyncAction]*jsonTotal `json:"totals"`
+	Files      []jsonOutcome             `json:"files"`
+}
+
+// WriteJSON prints the report as a single JSON document
+func (r *SyncReport) WriteJSON(w io.Writer) error {
+	out := jsonReport{
+		DryRun:     r.DryRun,
+		StartedAt:  r.StartedAt,
+		DurationMs: r.Duration.Milliseconds(),
+		Failed:     len(r.Failed()),
+		Skipped:    len(r.Skipped()),
+		Totals:     make(map[SyncAction]*jsonTotal),
+		Files:      []jsonOutcome{},
+	}
+	for _, action := range SYNC_ACTIONS {
+		files, bytes := r.Total(action)
+		out.Totals[action] = &jsonTotal{Files: files, Bytes: bytes}
+	}
+	for _, outcome := range r.Files {
+		o := jsonOutcome{
+			Filename:    outcome.Filename,
+			RenamedFrom: outcome.RenamedFrom,
+			Action:      outcome.Action,
+			Bytes:       outcome.Bytes,
+			DurationMs:  outcome.Duration.Milliseconds(),
+		}
+		if outcome.Err != nil {
+			o.Error = outcome.Err.Error()
+		}
+		out.Files = append(out.Files, o)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(out)
+}
+
+// SyncStageError is returned by ClientSync when a stage that every file
+// depends on fails, e.g. the local index cannot be read
+type SyncStageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *SyncStageError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Stage, e.Err)
+}
+
+func (e *SyncStageError) Unwrap() error {
+	return e.Err
+}
+
+// PartialSyncError is returned by ClientSync when the sync completed
+// but some files failed
+type PartialSyncError struct {
+	Failed []FileOutcome
+}
+
+func (e *PartialSyncError) Error() string {
+	var msgs []string
+	for _, outcome := range e.Failed {
+		msgs = append(msgs, fmt.Sprintf("%s %s: %v", outcome.Action, outcome.displayName(), outcome.Err))
+	}
+	return fmt.Sprintf("%d files failed to sync: %s", len(e.Failed), strings.Join(msgs, "; "))
+}
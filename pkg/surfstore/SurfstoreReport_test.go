@@ -0,0 +1,32 @@
+package surfstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSyncReportSkipsAreNotFailures(t *testing.T) {
+	tests := []struct {
+		name        string
+		action      SyncAction
+		err         error
+		wantFailed  int
+		wantSkipped int
+	}{
+		{"upload", ACTION_UPLOAD, nil, 0, 0},
+		{"failed upload", ACTION_UPLOAD, errors.New("unavailable"), 1, 0},
+		{"failed download", ACTION_DOWNLOAD, errors.New("unavailable"), 1, 0},
+		{"unreadable file", ACTION_SKIP, errors.New("permission denied"), 0, 1},
+	}
+	for _, tt := range tests {
+		report := newSyncReport()
+		report.add("f", tt.action, time.Now(), 0, tt.err)
+		if got := len(report.Failed()); got != tt.wantFailed {
+			t.Errorf("%s: %d failed, want %d", tt.name, got, tt.wantFailed)
+		}
+		if got := len(report.Skipped()); got != tt.wantSkipped {
+			t.Errorf("%s: %d skipped, want %d", tt.name, got, tt.wantSkipped)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package surfstore
+
+import (
+	context "context"
+	"log"
+	"math/rand"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy decides which failed RPCs RPCClient retries and how long it
+// waits in between. The wait starts at InitialBackoff and grows by
+// Multiplier up to MaxBackoff, and each wait is moved by a random amount
+// of up to Jitter times itself so that clients do not retry in lockstep.
+// Every attempt gets at most Timeout, plus the time the bytes it moves take
+// at MinThroughput bytes per second, so large blocks and pages still get
+// through a slow link. A zero Timeout leaves attempts to the caller's ctx.
+type RetryPolicy struct {
+	MaxAttempts    int
+	Timeout        time.Duration
+	MinThroughput  int64
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         float64
+	RetryableCodes []codes.Code
+}
+
+// DefaultRetryPolicy is used for idempotent calls, which are safe to repeat
+// after any transient failure
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    5,
+		Timeout:        time.Second,
+		MinThroughput:  DEFAULT_MIN_THROUGHPUT,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     5 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+		RetryableCodes: []codes.Code{codes.Unavailable, codes.DeadlineExceeded, codes.Aborted},
+	}
+}
+
+// MutationRetryPolicy is used for calls that change metadata, such as
+// UpdateFile, which are only retried when the server was unreachable. An
+// attempt may have committed before the connection failed; the MetaStore
+// then rejects its replay for the version, and RPCClient takes the
+// rejection as success if the stored metadata is what it sent.
+func MutationRetryPolicy() RetryPolicy {
+	policy := DefaultRetryPolicy()
+	policy.RetryableCodes = []codes.Code{codes.Unavailable}
+	return policy
+}
+
+// do runs call until it succeeds, fails with a code the policy does not
+// retry, runs out of attempts or ctx is done. Each attempt gets a context
+// derived from ctx with the policy's timeout. A server asking for a longer
+// wait with a RetryInfo detail, e.g. a rate limited BlockStore, gets it.
+func (policy RetryPolicy) do(ctx context.Context, call func(ctx context.Context) error) error {
+	backoff := policy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := policy.attempt(ctx, call)
+		if err == nil || attempt >= policy.MaxAttempts || !policy.retryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		wait := policy.jittered(backoff)
+		if after := retryAfter(err); after > wait {
+			wait = after
+		}
+		log.Printf("[RPCClient] attempt %d failed, retrying in %v: %v\n", attempt, wait, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+
+		backoff = time.Duration(float64(backoff) * policy.Multiplier)
+		if backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+// sized returns the policy for a call that moves up to n bytes
+func (policy RetryPolicy) sized(n int) RetryPolicy {
+	if policy.Timeout > 0 && policy.MinThroughput > 0 {
+		policy.Timeout += time.Duration(float64(n) / float64(policy.MinThroughput) * float64(time.Second))
+	}
+	return policy
+}
+
+func (policy RetryPolicy) attempt(ctx context.Context, call func(ctx context.Context) error) error {
+	if policy.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.Timeout)
+		defer cancel()
+	}
+	return call(ctx)
+}
+
+// retryAfter returns the wait a server asked for in a RetryInfo detail
+func retryAfter(err error) time.Duration {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			return info.RetryDelay.AsDuration()
+		}
+	}
+	return 0
+}
+
+func (policy RetryPolicy) retryable(err error) bool {
+	code := status.Code(err)
+	for _, retryable := range policy.RetryableCodes {
+		if code == retryable {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy RetryPolicy) jittered(backoff time.Duration) time.Duration {
+	if policy.Jitter <= 0 {
+		return backoff
+	}
+	delta := (rand.Float64()*2 - 1) * policy.Jitter * float64(backoff)
+	return backoff + time.Duration(delta)
+}
@@ -0,0 +1,17 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package surfstore
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode returns the inode number of a file, which changes when the
+// file is replaced rather than modified in place
+func fileInode(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
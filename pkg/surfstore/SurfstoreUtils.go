@@ -1,211 +1,1248 @@
 package surfstore
 
 import (
+	context "context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"io/fs"
 	"log"
-	"math"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
+// SyncOptions controls how ClientSync runs
+type SyncOptions struct {
+	// DryRun plans the sync and reports the planned actions without
+	// transferring blocks, committing metadata or touching the base directory
+	DryRun bool
+
+	// Excludes are ignore patterns applied on top of the .surfignore file
+	Excludes []string
+
+	// Selection replaces the path prefixes saved in the local index, which
+	// limit the files that are synced. nil keeps the saved selection and an
+	// empty slice selects everything.
+	Selection []string
+
+	// FullRescan hashes every file even if the stat cache in the local
+	// index says it is unchanged
+	FullRescan bool
+
+	// Progress, if set, is told how the transfers are going
+	Progress ProgressReporter
+}
+
+// A stat is only cached once the file is older than this, since a write in
+// the same modification time tick as the scan would go unnoticed
+const statCacheMinAge = time.Second
+
+// UpdateFiles batches stay well below gRPC's 4 MiB message limit
+const updateBatchMaxBytes = 1 << 20
+
+// plannedAction is one step ClientSync decided on. local is the file's
+// entry in the local index, remote is the server's metadata. A rename also
+// carries the tombstone of the old name in from; for a local rename remote
+// is the server's metadata of the old name, which the rename is based on.
+type plannedAction struct {
+	action SyncAction
+	local  *FileMetaData
+	remote *FileMetaData
+	from   *FileMetaData
+	// metadataOnly uploads leave the blocks alone, the server has them
+	metadataOnly bool
+}
+
+// syncPlan is the result of comparing the base directory, the local
+// index and the server
+type syncPlan struct {
+	index   *LocalIndex
+	changes *ChangeList
+	address string
+	uploads []plannedAction
+	// downloads also include conflicts, where the server's version wins
+	downloads []plannedAction
+	// a file that could not be read changed on the server, so the change
+	// feed position must not move past the change
+	skippedChanges bool
+}
+
 // Implement the logic for a client syncing with the server here.
-func ClientSync(client RPCClient) {
-	fmt.Printf("[Client %s] start func ClientSync\n", client.BaseDir)
+// The report lists every action taken, even when an error is returned.
+// Once ctx is done no further file is started, the local index is saved
+// with what completed and ctx's error is returned.
+func ClientSync(ctx context.Context, client RPCClient, opts SyncOptions) (*SyncReport, error) {
+	log.Printf("[Client %s] start func ClientSync\n", client.BaseDir)
+	report := newSyncReport()
+	report.DryRun = opts.DryRun
+
+	blockSize, err := negotiateBlockSize(ctx, client)
+	if err != nil {
+		return report.finish(&SyncStageError{Stage: STAGE_SERVER, Err: err})
+	}
+	client.BlockSize = blockSize
+
+	plan, err := planSync(ctx, client, opts, report)
+	if ctx.Err() != nil {
+		return report.finish(ctx.Err())
+	}
+	if err != nil {
+		return report.finish(err)
+	}
+
+	if opts.DryRun {
+		for _, planned := range plan.uploads {
+			if planned.action == ACTION_RENAME {
+				report.addRename(planned.from.Filename, planned.local.Filename, time.Now(), 0, nil)
+				continue
+			}
+			report.add(planned.local.Filename, planned.action, time.Now(), planned.local.Size, nil)
+		}
+		for _, planned := range plan.downloads {
+			if planned.action == ACTION_RENAME {
+				report.addRename(planned.from.Filename, planned.remote.Filename, time.Now(), 0, nil)
+				continue
+			}
+			report.add(planned.remote.Filename, planned.action, time.Now(), planned.remote.Size, nil)
+		}
+		return report.finish(nil)
+	}
+
+	// journal the uploads, so an interrupted sync resumes them
+	journal, err := loadUploadJournal(client.BaseDir)
+	if err != nil {
+		return report.finish(&SyncStageError{Stage: STAGE_INDEX, Err: err})
+	}
+	pending := &uploadJournal{Uploads: make(map[string]*journalEntry)}
+	resumed := make(map[string]bool)
+	for _, planned := range plan.uploads {
+		if planned.action != ACTION_UPLOAD || planned.metadataOnly || planned.local.SymlinkTarget != "" {
+			continue
+		}
+		resumed[planned.local.Filename] = journal.resumes(planned.local)
+		pending.add(planned.local)
+	}
+	if err := pending.write(client.BaseDir); err != nil {
+		return report.finish(&SyncStageError{Stage: STAGE_INDEX, Err: err})
+	}
+
+	// blocks go up file by file, then the metadata of every file whose
+	// blocks made it is committed together
+	progress := newProgressTracker(opts.Progress, plan)
+	var staged []stagedUpload
+	for _, planned := range plan.uploads {
+		if ctx.Err() != nil {
+			break
+		}
+		start := time.Now()
+		if planned.action == ACTION_RENAME {
+			err := renameRemote(ctx, client, planned.from, planned.remote.Version, planned.local)
+			report.addRename(planned.from.Filename, planned.local.Filename, start, 0, err)
+			progress.fileDone(planned)
+			continue
+		}
+		progress.startFile(planned.local.Filename)
+		bytes, err := upload(ctx, client, planned.local, plan.address, !planned.metadataOnly, resumed[planned.local.Filename], progress)
+		progress.fileDone(planned)
+		if err != nil {
+			report.add(planned.local.Filename, planned.action, start, bytes, err)
+			continue
+		}
+		staged = append(staged, stagedUpload{planned: planned, start: start, bytes: bytes})
+	}
+
+	errs := commitUploads(ctx, client, staged)
+	for i, entry := range staged {
+		action, err := entry.planned.action, errs[i]
+		if err == nil {
+			delete(pending.Uploads, entry.planned.local.Filename)
+		}
+		if status.Code(err) == codes.FailedPrecondition && MissingBlocks(err) == nil {
+			// someone else committed a newer version first
+			action = ACTION_CONFLICT
+		}
+		report.add(entry.planned.local.Filename, action, entry.start, entry.bytes, err)
+	}
+
+	// only the failed uploads are left to resume
+	if err := pending.write(client.BaseDir); err != nil {
+		return report.finish(&SyncStageError{Stage: STAGE_INDEX, Err: err})
+	}
+
+	//Check for updates on server, download
+	for _, planned := range plan.downloads {
+		if ctx.Err() != nil {
+			break
+		}
+		start := time.Now()
+		if planned.action == ACTION_RENAME {
+			local, err := renameLocal(ctx, client, planned.local, planned.remote, plan.address)
+			if err == nil {
+				plan.index.Files[planned.remote.Filename] = local
+				plan.index.Files[planned.from.Filename] = proto.Clone(planned.from).(*FileMetaData)
+				delete(plan.index.Stats, planned.from.Filename)
+				plan.index.recordStat(client.BaseDir, planned.remote.Filename, fileBlockSize(local, client.BlockSize))
+			}
+			report.addRename(planned.from.Filename, planned.remote.Filename, start, 0, err)
+			progress.fileDone(planned)
+			continue
+		}
+		local := planned.local
+		if local == nil {
+			local = &FileMetaData{}
+		}
+		progress.startFile(planned.remote.Filename)
+		bytes, err := download(ctx, client, local, planned.remote, plan.address, progress)
+		progress.fileDone(planned)
+		if err == nil {
+			plan.index.Files[planned.remote.Filename] = local
+			plan.index.recordStat(client.BaseDir, planned.remote.Filename, fileBlockSize(local, client.BlockSize))
+		}
+		report.add(planned.remote.Filename, planned.action, start, bytes, err)
+	}
+
+	// after a failure or cancellation the index no longer mirrors the
+	// server, so the next sync has to start from the full FileInfoMap again.
+	// Skipped files keep the position unless a server change was skipped.
+	failed := report.Failed()
+	plan.index.Epoch, plan.index.LastSeq = plan.changes.Epoch, plan.changes.LatestSeq
+	if len(failed) > 0 || plan.skippedChanges || ctx.Err() != nil {
+		plan.index.Epoch, plan.index.LastSeq = "", 0
+	}
+	if err := plan.index.Write(client.BaseDir); err != nil {
+		return report.finish(&SyncStageError{Stage: STAGE_INDEX, Err: err})
+	}
+	if ctx.Err() != nil {
+		return report.finish(ctx.Err())
+	}
+	if len(failed) > 0 {
+		return report.finish(&PartialSyncError{Failed: failed})
+	}
+	return report.finish(nil)
+}
 
-	// lookup the index.txt file. if not, create one
-	indexFilePath := ConcatPath(client.BaseDir, "/index.txt")
-	if _, err := os.Stat(indexFilePath); errors.Is(err, os.ErrNotExist) {
-		indexFile, _ := os.Create(indexFilePath)
-		indexFile.Close()
+// planSync scans the base directory, bumps the version of every local
+// change in the loaded index, and compares the result with the server's
+// changes to decide what to upload and download. It does not write anything.
+func planSync(ctx context.Context, client RPCClient, opts SyncOptions, report *SyncReport) (*syncPlan, error) {
+	ignore, err := LoadIgnoreMatcher(client.BaseDir, opts.Excludes)
+	if err != nil {
+		return nil, &SyncStageError{Stage: STAGE_SCAN, Err: err}
 	}
-	// read the directory and get file info of the client into the map
-	files, err := ioutil.ReadDir(client.BaseDir)
+
+	// read the directory tree and get file info of the client into the map
+	files, err := scanBaseDir(client.BaseDir, ignore)
 	if err != nil {
-		log.Fatalf("error while reading directory : %v", err)
+		return nil, &SyncStageError{Stage: STAGE_SCAN, Err: err}
 	}
 	/*
 		Read the index.txt to get the current client matadata info
 	*/
 
 	//Load the index.txt file
-	metaDataMap, err := LoadMetaFromMetaFile(client.BaseDir)
+	localIndex, err := LoadLocalIndex(client.BaseDir)
 	if err != nil {
-		log.Fatalf("error while reading index.txt, %v", err)
+		return nil, &SyncStageError{Stage: STAGE_INDEX, Err: err}
 	}
-	remoteFileMetaMap := make(map[string]*FileMetaData)
-	err = client.GetFileInfoMap(&remoteFileMetaMap)
-	if err != nil {
-		log.Fatalf("error while getting server info map, %v", err)
+	if selection := normalizeSelection(opts.Selection); opts.Selection != nil &&
+		!reflect.DeepEqual(selection, localIndex.Selection) {
+		localIndex.Selection = selection
+		// files that were never synced may now be selected, so list them all
+		localIndex.Epoch, localIndex.LastSeq = "", 0
+	}
+	if hash := ignore.Hash(); hash != localIndex.IgnoreHash {
+		localIndex.IgnoreHash = hash
+		// changes to files that were ignored until now were never applied
+		localIndex.Epoch, localIndex.LastSeq = "", 0
+	}
+	metaDataMap := localIndex.Files
+	// the index holds the server's metadata as of the last synced sequence number
+	syncedIndex := make(map[string]*FileMetaData)
+	for fileName, metaData := range metaDataMap {
+		syncedIndex[fileName] = proto.Clone(metaData).(*FileMetaData)
 	}
 
-	fileMap := make(map[string][]string)
+	scanned := make(map[string]*FileMetaData)
+	// new files, and deleted ones by their content, to pair up renames
+	var appeared []string
+	disappeared := make(map[string][]string)
+	// files that could not be read or are ignored are neither uploaded,
+	// deleted nor overwritten
+	skipped := make(map[string]bool)
+	unreadable := make(map[string]bool)
 	//iterate through all the file in the map and compare
-	for _, file := range files {
-		if file.Name() == "index.txt" {
+	for fileName, file := range files {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !localIndex.Selected(fileName) {
+			skipped[fileName] = true
 			continue
 		}
-
-		var num int = int(math.Ceil(float64(file.Size()) / float64(client.BlockSize)))
-		readFile, err := os.Open(client.BaseDir + "/" + file.Name())
+		start := time.Now()
+		// a file keeps the block size it was first chunked with
+		blockSize := client.BlockSize
+		if val, exists := metaDataMap[fileName]; exists {
+			blockSize = fileBlockSize(val, client.BlockSize)
+		}
+		stat := newFileStat(file, blockSize)
+		var cached *FileMetaData
+		if cachedStat, ok := localIndex.Stats[fileName]; ok && !opts.FullRescan && *cachedStat == *stat {
+			cached = metaDataMap[fileName]
+		}
+		meta, err := scanFile(client.BaseDir, fileName, file, blockSize, cached)
 		if err != nil {
-			log.Println("error in opening file", err)
+			report.add(fileName, ACTION_SKIP, start, 0, err)
+			delete(localIndex.Stats, fileName)
+			skipped[fileName] = true
+			unreadable[fileName] = true
+			continue
 		}
-		//Read bytes from file in base directory
-		for i := 0; i < num; i++ {
-			slice := make([]byte, client.BlockSize)
-			len, err := readFile.Read(slice)
-			if err != nil {
-				log.Println(err)
-			}
-			slice = slice[:len]
-			hash := GetBlockHashString(slice)
-			fileMap[file.Name()] = append(fileMap[file.Name()], hash)
+		scanned[fileName] = meta
+		if file.Mode().IsRegular() && time.Since(file.ModTime()) >= statCacheMinAge {
+			localIndex.Stats[fileName] = stat
+		} else {
+			delete(localIndex.Stats, fileName)
 		}
 
-		if val, exists := metaDataMap[file.Name()]; exists {
-			if !reflect.DeepEqual(fileMap[file.Name()], val.BlockHashList) {
-				metaDataMap[file.Name()].BlockHashList = fileMap[file.Name()]
-				metaDataMap[file.Name()].Version++
+		if val, exists := metaDataMap[fileName]; exists {
+			if isTombstone(val) {
+				appeared = append(appeared, fileName)
+			}
+			if val.Mode == 0 {
+				// the index predates file modes, adopt the local one
+				val.Mode = meta.Mode
+			}
+			if val.BlockSize == 0 && val.SymlinkTarget == "" {
+				// the index predates per-file block sizes
+				val.BlockSize = meta.BlockSize
+			}
+			if val.ContentHash == "" && sameFile(val, meta) {
+				// the index predates content hashes
+				val.ContentHash = meta.ContentHash
+			}
+			if len(val.BlockHashList) == 0 && val.BlockTreeRoot != "" && sameFile(val, meta) {
+				// the entry was taken from the server, which only has the tree
+				val.BlockHashList = meta.BlockHashList
+			}
+			if !sameFile(val, meta) {
+				if !sameHashes(val, meta) {
+					// the tree is stored again by the upload
+					val.BlockTreeRoot = ""
+				}
+				val.BlockHashList = meta.BlockHashList
+				val.SymlinkTarget = meta.SymlinkTarget
+				val.Mode = meta.Mode
+				val.ModTime = meta.ModTime
+				val.Size = meta.Size
+				val.BlockSize = meta.BlockSize
+				val.ContentHash = meta.ContentHash
+				val.Deleted = false
+				val.DeletedAt = 0
+				val.DeletedBy = ""
+				val.Version++
 			}
 		} else {
 			// Make a new file of version 1
-			meta := FileMetaData{
-				Filename:      file.Name(),
-				Version:       1,
-				BlockHashList: fileMap[file.Name()]}
-			metaDataMap[file.Name()] = &meta
+			meta.Version = 1
+			metaDataMap[fileName] = meta
+			appeared = append(appeared, fileName)
+		}
+	}
+
+	// an ignored or unselected file missing from the scan was not deleted
+	for fileName := range metaDataMap {
+		if ignore.Match(fileName, false) || !localIndex.Selected(fileName) {
+			skipped[fileName] = true
 		}
 	}
 
 	// iterate through all the indexfile and compare
 	for fileName, metaData := range metaDataMap {
-		if _, exists := fileMap[fileName]; !exists {
-			if len(metaData.BlockHashList) != 1 || metaData.BlockHashList[0] != "0" {
+		if _, exists := scanned[fileName]; !exists && !skipped[fileName] {
+			delete(localIndex.Stats, fileName)
+			if !isTombstone(metaData) {
+				if key := contentKey(metaData); key != "" {
+					disappeared[key] = append(disappeared[key], fileName)
+				}
 				metaData.Version++
-				metaData.BlockHashList = []string{"0"}
-			} else {
-				fmt.Print("The file is unchanged")
+				metaData.Deleted = true
 			}
 		}
-		fmt.Printf("[Client %s] finished syncing from local\n", client.BaseDir)
 	}
+	log.Printf("[Client %s] finished syncing from local\n", client.BaseDir)
 
 	var address string
-	if err := client.GetBlockStoreAddr(&address); err != nil {
-		log.Println(err)
+	if err := client.GetBlockStoreAddr(ctx, &address); err != nil {
+		return nil, &SyncStageError{Stage: STAGE_SERVER, Err: err}
 	}
 
+	// only fetch what changed on the server since the last sync
+	var changes ChangeList
+	if err := client.GetChangesSince(ctx, localIndex.Epoch, localIndex.LastSeq, &changes); err != nil {
+		return nil, &SyncStageError{Stage: STAGE_SERVER, Err: err}
+	}
 	remoteIndex := make(map[string]*FileMetaData)
-	if err := client.GetFileInfoMap(&remoteIndex); err != nil {
-		log.Println(err)
+	if changes.Full {
+		files, err := listFiles(ctx, client, localIndex.Selection)
+		if err != nil {
+			return nil, &SyncStageError{Stage: STAGE_SERVER, Err: err}
+		}
+		changes.Files = files
+	} else {
+		// a copy, so syncedIndex still tells which files changed locally
+		for fileName, metaData := range syncedIndex {
+			remoteIndex[fileName] = metaData
+		}
+	}
+	// the same MetaStore only lists everything again when tombstones this
+	// client never saw were purged
+	purged := changes.Full && localIndex.Epoch != "" && changes.Epoch == localIndex.Epoch
+	for _, meta := range changes.Files {
+		remoteIndex[meta.Filename] = meta
+	}
+
+	plan := &syncPlan{index: localIndex, changes: &changes, address: address}
+	for file := range unreadable {
+		remote, exists := remoteIndex[file]
+		if synced, ok := syncedIndex[file]; exists && (!ok || synced.Version != remote.Version) {
+			plan.skippedChanges = true
+		}
+	}
+
+	// a file that disappeared while one with the same content appeared was
+	// renamed, if the server still has the old name and not the new one
+	renamed := make(map[string]bool)
+	sort.Strings(appeared)
+	for _, file := range appeared {
+		key := contentKey(metaDataMap[file])
+		for i, from := range disappeared[key] {
+			remoteFrom, exists := remoteIndex[from]
+			if !exists || isTombstone(remoteFrom) {
+				continue
+			}
+			if remoteTo, exists := remoteIndex[file]; exists && !isTombstone(remoteTo) {
+				break
+			}
+			renamed[from], renamed[file] = true, true
+			disappeared[key] = append(disappeared[key][:i], disappeared[key][i+1:]...)
+			plan.uploads = append(plan.uploads, plannedAction{action: ACTION_RENAME, local: metaDataMap[file], remote: remoteFrom, from: metaDataMap[from]})
+			break
+		}
 	}
 
 	for file, meta := range metaDataMap {
-		if remoteMetaData, exists := remoteIndex[file]; exists {
-			if meta.Version > remoteMetaData.Version {
-				upload(client, meta, address)
+		if skipped[file] || renamed[file] {
+			continue
+		}
+		if _, exists := remoteIndex[file]; !exists && isTombstone(meta) {
+			// the server never had the file, or purged its tombstone
+			delete(metaDataMap, file)
+			continue
+		}
+		if synced, ok := syncedIndex[file]; ok && purged && meta.Seq > 0 && meta.Version == synced.Version {
+			if _, exists := remoteIndex[file]; !exists {
+				// an unchanged file the server sent before was deleted
+				tombstone := proto.Clone(meta).(*FileMetaData)
+				tombstone.Deleted = true
+				plan.downloads = append(plan.downloads, plannedAction{action: ACTION_DELETE_LOCAL, local: meta, remote: tombstone})
+				continue
 			}
-		} else {
-			upload(client, meta, address)
+		}
+		if remoteMetaData, exists := remoteIndex[file]; !exists || meta.Version > remoteMetaData.Version {
+			// the MetaStore only takes the version after its own, however
+			// often the file changed since the last successful sync
+			meta.Version = 1
+			if exists {
+				meta.Version = remoteMetaData.Version + 1
+			}
+			plan.uploads = append(plan.uploads, plannedAction{
+				action: uploadAction(meta),
+				local:  meta,
+				// e.g. a chmod, the server already has every block
+				metadataOnly: exists && !isTombstone(remoteMetaData) && sameHashes(meta, remoteMetaData),
+			})
 		}
 	}
 
 	//Check for updates on server, download
 	for file, meta := range remoteIndex {
-		if localMetaData, exists := metaDataMap[file]; exists {
-			if localMetaData.Version < meta.Version {
-				download(client, localMetaData, meta, address)
-			} else if localMetaData.Version == meta.Version && !reflect.DeepEqual(localMetaData.BlockHashList, meta.BlockHashList) {
-				download(client, localMetaData, meta, address)
+		if skipped[file] || ignore.Match(file, false) || !localIndex.Selected(file) {
+			continue
+		}
+		if err := ValidFileName(file); err != nil {
+			log.Printf("[Client %s] not syncing %v\n", client.BaseDir, err)
+			continue
+		}
+		localMetaData, exists := metaDataMap[file]
+		switch {
+		case !exists && isTombstone(meta):
+			// nothing to delete, just remember the server's tombstone
+			metaDataMap[file] = proto.Clone(meta).(*FileMetaData)
+		case !exists:
+			plan.downloads = append(plan.downloads, plannedAction{action: ACTION_DOWNLOAD, remote: meta})
+		case localMetaData.Version < meta.Version && changedSinceSync(localMetaData, syncedIndex[file]) && !sameFile(localMetaData, meta):
+			// both sides changed the file since the last sync, however far
+			// ahead the server is, and the server's version wins
+			plan.downloads = append(plan.downloads, plannedAction{action: ACTION_CONFLICT, local: localMetaData, remote: meta})
+		case localMetaData.Version < meta.Version:
+			plan.downloads = append(plan.downloads, plannedAction{action: downloadAction(meta), local: localMetaData, remote: meta})
+		case localMetaData.Version == meta.Version && !sameFile(localMetaData, meta):
+			if sameLocalFile(client.BaseDir, localMetaData, meta) {
+				// the same content chunked with another block size, keep the server's
+				hashes := localMetaData.BlockHashList
+				proto.Reset(localMetaData)
+				proto.Merge(localMetaData, meta)
+				keepBlockList(localMetaData, hashes)
+				break
 			}
-		} else {
-			metaDataMap[file] = &FileMetaData{}
-			localMetaData := metaDataMap[file]
-			download(client, localMetaData, meta, address)
+			// both sides changed the file since the last sync, the server's version wins
+			plan.downloads = append(plan.downloads, plannedAction{action: ACTION_CONFLICT, local: localMetaData, remote: meta})
 		}
 	}
+	plan.downloads = planLocalRenames(plan.downloads, scanned)
 
-	WriteMetaFile(metaDataMap, client.BaseDir)
+	sort.Slice(plan.uploads, func(i, j int) bool {
+		return plan.uploads[i].local.Filename < plan.uploads[j].local.Filename
+	})
+	// deletes go first, so a file can take the place of a directory that
+	// was emptied by them, and the other way round
+	sort.Slice(plan.downloads, func(i, j int) bool {
+		iDelete := plan.downloads[i].action == ACTION_DELETE_LOCAL
+		jDelete := plan.downloads[j].action == ACTION_DELETE_LOCAL
+		if iDelete != jDelete {
+			return iDelete
+		}
+		return plan.downloads[i].remote.Filename < plan.downloads[j].remote.Filename
+	})
+	return plan, nil
 }
 
-func download(client RPCClient, local *FileMetaData, remote *FileMetaData, address string) error {
-	filePath := client.BaseDir + "/" + remote.Filename
-	file, err := os.Create(filePath)
-	if err != nil {
-		log.Println(err)
+// listFiles pages through every file on the server under the selected
+// prefixes, or all files if nothing is selected
+func listFiles(ctx context.Context, client RPCClient, selection []string) ([]*FileMetaData, error) {
+	prefixes := selection
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
 	}
-	defer file.Close()
 
-	*local = *remote
+	var files []*FileMetaData
+	seen := make(map[string]bool)
+	for _, prefix := range prefixes {
+		pageToken := ""
+		for {
+			var page []*FileMetaData
+			if err := client.ListFiles(ctx, prefix, DEFAULT_LIST_PAGE_SIZE, pageToken, &page, &pageToken); err != nil {
+				return nil, err
+			}
+			for _, meta := range page {
+				// nested prefixes list some files twice
+				if !seen[meta.Filename] {
+					seen[meta.Filename] = true
+					files = append(files, meta)
+				}
+			}
+			if pageToken == "" {
+				break
+			}
+		}
+	}
+	return files, nil
+}
 
-	if len(remote.BlockHashList) == 1 && remote.BlockHashList[0] == "0" {
-		if err := os.Remove(filePath); err != nil {
-			log.Println(err)
+// planLocalRenames turns the download of a file renamed on the server, and
+// the deletion of its old name, into a local rename when this client still
+// has the old file unchanged and nothing is in the way of the new name
+func planLocalRenames(downloads []plannedAction, scanned map[string]*FileMetaData) []plannedAction {
+	deletes := make(map[string]int)
+	for i, planned := range downloads {
+		if planned.action == ACTION_DELETE_LOCAL {
+			deletes[planned.remote.Filename] = i
+		}
+	}
+
+	consumed := make(map[int]bool)
+	for i, planned := range downloads {
+		from := planned.remote.RenamedFrom
+		if planned.action != ACTION_DOWNLOAD || from == "" {
+			continue
+		}
+		j, ok := deletes[from]
+		if !ok || consumed[j] {
+			continue
+		}
+		oldFile, ok := scanned[from]
+		if !ok || contentKey(oldFile) != contentKey(planned.remote) {
+			continue
+		}
+		if _, ok := scanned[planned.remote.Filename]; ok {
+			continue
+		}
+		downloads[i] = plannedAction{action: ACTION_RENAME, local: downloads[j].local, remote: planned.remote, from: downloads[j].remote}
+		consumed[j] = true
+	}
+
+	renamed := downloads[:0]
+	for i, planned := range downloads {
+		if !consumed[i] {
+			renamed = append(renamed, planned)
+		}
+	}
+	return renamed
+}
+
+// scanBaseDir walks the base directory and returns every regular file and
+// symlink that is not ignored, keyed by its slash-separated path relative to
+// baseDir. Symlinks are not followed.
+func scanBaseDir(baseDir string, ignore *IgnoreMatcher) (map[string]os.FileInfo, error) {
+	files := make(map[string]os.FileInfo)
+	err := filepath.WalkDir(baseDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == baseDir {
+			return nil
+		}
+		rel, err := filepath.Rel(baseDir, path)
+		if err != nil {
 			return err
 		}
+		fileName := filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			if ignore.Match(fileName, true) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		isLink := d.Type()&fs.ModeSymlink != 0
+		if IsMetaFile(fileName) || (!d.Type().IsRegular() && !isLink) || ignore.Match(fileName, false) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[fileName] = info
 		return nil
+	})
+	return files, err
+}
+
+// scanFile builds the metadata of a scanned file, without a version. The
+// blocks of a regular file are hashed unless the cached metadata, whose
+// stat matched, already has them. A symlink only records its target.
+func scanFile(baseDir string, fileName string, info os.FileInfo, blockSize int, cached *FileMetaData) (*FileMetaData, error) {
+	meta := &FileMetaData{
+		Filename: fileName,
+		Mode:     uint32(info.Mode().Perm()),
+		ModTime:  info.ModTime().UnixNano(),
 	}
+	filePath := ConcatPath(baseDir, fileName)
 
-	temp := ""
-	for _, hash := range remote.BlockHashList {
-		var b Block
-		if err := client.GetBlock(hash, address, &b); err != nil {
-			log.Println(err)
+	if info.Mode()&fs.ModeSymlink != 0 {
+		target, err := os.Readlink(filePath)
+		if err != nil {
+			return nil, err
 		}
+		meta.SymlinkTarget = target
+		return meta, nil
+	}
+
+	meta.BlockSize = int32(blockSize)
+	if cached != nil && cached.SymlinkTarget == "" && !isTombstone(cached) && cached.ContentHash != "" &&
+		(len(cached.BlockHashList) > 0 || cached.BlockTreeRoot == "") {
+		meta.BlockHashList = cached.BlockHashList
+		meta.ContentHash = cached.ContentHash
+		meta.Size = cached.Size
+		return meta, nil
+	}
+
+	hashes, contentHash, err := hashFile(filePath, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	meta.BlockHashList = hashes
+	meta.ContentHash = contentHash
+	meta.Size = info.Size()
+	return meta, nil
+}
 
-		temp += string(b.BlockData)
+func newFileStat(info os.FileInfo, blockSize int) *FileStat {
+	return &FileStat{
+		Size:      info.Size(),
+		ModTime:   info.ModTime().UnixNano(),
+		Inode:     fileInode(info),
+		BlockSize: blockSize,
 	}
-	file.WriteString(temp)
+}
 
+// recordStat caches the stat of a file that was just downloaded, so the
+// next scan does not hash it again
+func (index *LocalIndex) recordStat(baseDir string, fileName string, blockSize int) {
+	info, err := os.Lstat(ConcatPath(baseDir, fileName))
+	if err != nil || !info.Mode().IsRegular() || time.Since(info.ModTime()) < statCacheMinAge {
+		delete(index.Stats, fileName)
+		return
+	}
+	index.Stats[fileName] = newFileStat(info, blockSize)
+}
+
+// hashFile splits a file into blocks and returns their hashes
+func hashFile(filePath string, blockSize int) ([]string, string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+
+	var hashes []string
+	whole := sha256.New()
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(file, block)
+		if n > 0 {
+			hashes = append(hashes, GetBlockHashString(block[:n]))
+			whole.Write(block[:n])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return hashes, hex.EncodeToString(whole.Sum(nil)), nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+	}
+}
+
+// sameHashes reports whether two versions of a file consist of the same
+// blocks. When a block list is only known by its tree, the roots decide.
+func sameHashes(a *FileMetaData, b *FileMetaData) bool {
+	if (a.BlockTreeRoot != "" && len(a.BlockHashList) == 0) || (b.BlockTreeRoot != "" && len(b.BlockHashList) == 0) {
+		return blockTreeRoot(a) == blockTreeRoot(b)
+	}
+	if len(a.BlockHashList) != len(b.BlockHashList) {
+		return false
+	}
+	for i := range a.BlockHashList {
+		if a.BlockHashList[i] != b.BlockHashList[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameFile reports whether two versions of a file have the same content,
+// symlink target and mode. Modification times alone do not make a new
+// version. A mode of 0 was written by a client that did not record modes
+// and matches any mode.
+func sameFile(a *FileMetaData, b *FileMetaData) bool {
+	if a.Deleted || b.Deleted {
+		return a.Deleted == b.Deleted
+	}
+	if a.SymlinkTarget != b.SymlinkTarget || !sameHashes(a, b) {
+		return false
+	}
+	return a.Mode == 0 || b.Mode == 0 || a.Mode == b.Mode
+}
+
+// changedSinceSync reports whether a file was created, edited or deleted
+// locally since the last sync left synced in the index. The scan moves the
+// local version past the synced one when the file on disk differs from it.
+func changedSinceSync(local *FileMetaData, synced *FileMetaData) bool {
+	return synced == nil || local.Version != synced.Version
+}
+
+// sameLocalFile is sameFile for a local file and the server's entry for it.
+// When they were chunked with different block sizes, their content hashes
+// decide, and without those the local file is hashed again with the
+// server's block size before calling them different.
+func sameLocalFile(baseDir string, local *FileMetaData, remote *FileMetaData) bool {
+	if sameFile(local, remote) {
+		return true
+	}
+	if local.Deleted || remote.Deleted {
+		return false
+	}
+	if same, ok := SameContent(local, remote); ok || remote.BlockSize == 0 || local.Size != remote.Size {
+		return ok && same && (local.Mode == 0 || remote.Mode == 0 || local.Mode == remote.Mode)
+	}
+	hashes, _, err := hashFile(ConcatPath(baseDir, local.Filename), int(remote.BlockSize))
+	if err != nil {
+		return false
+	}
+	rechunked := proto.Clone(local).(*FileMetaData)
+	rechunked.BlockHashList = hashes
+	rechunked.BlockSize = remote.BlockSize
+	return sameFile(rechunked, remote)
+}
+
+// verifyContent checks the size and SHA-256 of downloaded bytes against
+// the file's, if the uploader recorded a content hash
+func verifyContent(meta *FileMetaData, size int64, sum []byte) error {
+	if meta.ContentHash == "" {
+		return nil
+	}
+	if size != meta.Size || hex.EncodeToString(sum) != meta.ContentHash {
+		return fmt.Errorf("downloaded %d bytes of %s with SHA-256 %s, expected %d bytes with %s",
+			size, meta.Filename, hex.EncodeToString(sum), meta.Size, meta.ContentHash)
+	}
 	return nil
 }
 
-func upload(client RPCClient, meta *FileMetaData, address string) error {
-	fmt.Printf("[Client %s] start func upload\n", client.BaseDir)
+// fileBlockSize is the block size a file was chunked with, or the client's
+// for files recorded before block sizes were
+func fileBlockSize(meta *FileMetaData, clientBlockSize int) int {
+	if meta.BlockSize > 0 {
+		return int(meta.BlockSize)
+	}
+	return clientBlockSize
+}
+
+// negotiateBlockSize picks the block size for new files: the client's own
+// within the MetaStore's range, or the MetaStore's default if it has none
+func negotiateBlockSize(ctx context.Context, client RPCClient) (int, error) {
+	var blockSizes BlockSizeRange
+	if err := client.GetBlockSizeRange(ctx, &blockSizes); err != nil {
+		return 0, err
+	}
+	blockSize := client.BlockSize
+	switch {
+	case blockSize <= 0:
+		blockSize = int(blockSizes.DefaultSize)
+	case blockSize < int(blockSizes.MinSize):
+		blockSize = int(blockSizes.MinSize)
+	case blockSizes.MaxSize > 0 && blockSize > int(blockSizes.MaxSize):
+		blockSize = int(blockSizes.MaxSize)
+	}
+	if blockSize != client.BlockSize {
+		log.Printf("[Client %s] using block size %d, the MetaStore allows [%d, %d]\n", client.BaseDir, blockSize, blockSizes.MinSize, blockSizes.MaxSize)
+	}
+	return blockSize, nil
+}
+
+// contentKey identifies the content of a file for rename detection. Empty
+// files and tombstones have no key, since they all look alike. The key is
+// the same whether the block list is stored as a list or as a tree.
+func contentKey(meta *FileMetaData) string {
+	if isTombstone(meta) || (len(meta.BlockHashList) == 0 && meta.BlockTreeRoot == "" && meta.SymlinkTarget == "") {
+		return ""
+	}
+	return meta.SymlinkTarget + "\x00" + blockTreeRoot(meta)
+}
+
+// isTombstone reports whether the metadata marks a deleted file. A
+// tombstone keeps the content the file had, for undelete.
+func isTombstone(meta *FileMetaData) bool {
+	return meta.Deleted
+}
+
+func uploadAction(meta *FileMetaData) SyncAction {
+	if isTombstone(meta) {
+		return ACTION_DELETE_REMOTE
+	}
+	return ACTION_UPLOAD
+}
+
+func downloadAction(meta *FileMetaData) SyncAction {
+	if isTombstone(meta) {
+		return ACTION_DELETE_LOCAL
+	}
+	return ACTION_DOWNLOAD
+}
+
+// download streams the blocks of the remote file into a partial download
+// next to the local copy, checking the content hash on the way, and renames
+// it into place once complete. The local metadata is only updated once the
+// file is written. The mode and modification time of the remote file are
+// restored, and when only those changed no blocks are fetched. A block list
+// stored as a tree is expanded into the local metadata. It returns the
+// number of bytes downloaded.
+func download(ctx context.Context, client RPCClient, local *FileMetaData, remote *FileMetaData, address string, progress *progressTracker) (int64, error) {
+	filePath, err := localPath(client.BaseDir, remote.Filename)
+	if err != nil {
+		return 0, err
+	}
+
+	if isTombstone(remote) {
+		if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return 0, err
+		}
+		removeEmptyParents(client.BaseDir, filePath)
+		proto.Reset(local)
+		proto.Merge(local, remote)
+		return 0, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return 0, err
+	}
+	info, err := os.Lstat(filePath)
+	if err == nil && info.IsDir() {
+		// a directory emptied by the deletes of this sync makes way for the
+		// file, one that still holds files does not
+		if err := os.Remove(filePath); err != nil {
+			return 0, err
+		}
+	}
+	isRegular := err == nil && info.Mode().IsRegular()
+	if remote.SymlinkTarget != "" || (err == nil && info.Mode()&fs.ModeSymlink != 0) {
+		// never write through a symlink that is being replaced
+		if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return 0, err
+		}
+	}
+
+	if remote.SymlinkTarget != "" {
+		if err := os.Symlink(remote.SymlinkTarget, filePath); err != nil {
+			return 0, err
+		}
+		proto.Reset(local)
+		proto.Merge(local, remote)
+		return 0, nil
+	}
+
+	if remote.BlockTreeRoot != "" && len(remote.BlockHashList) == 0 {
+		hashes, err := expandBlockTree(ctx, client, remote.BlockTreeRoot, address, local)
+		if err != nil {
+			return 0, err
+		}
+		remote = proto.Clone(remote).(*FileMetaData)
+		remote.BlockHashList = hashes
+	}
 
-	filePath := client.BaseDir + "/" + meta.Filename
-	var mostRecentVer int32
-	if _, err := os.Stat(filePath); errors.Is(err, os.ErrNotExist) {
-		err = client.UpdateFile(meta, &mostRecentVer)
+	var downloaded int64
+	if same, ok := SameContent(local, remote); !isRegular || isTombstone(local) || !ok || !same {
+		tempPath := ConcatPath(filepath.Dir(filePath), PARTIAL_DOWNLOAD_PREFIX+filepath.Base(filePath))
+		err := writeAtomic(filePath, tempPath, 0644, func(w io.Writer) error {
+			sum := sha256.New()
+			for _, hash := range remote.BlockHashList {
+				var b Block
+				if err := client.GetBlock(ctx, hash, address, &b); err != nil {
+					return err
+				}
+				if _, err := w.Write(b.BlockData); err != nil {
+					return err
+				}
+				sum.Write(b.BlockData)
+				downloaded += int64(len(b.BlockData))
+				progress.block(len(b.BlockData))
+				if err := client.DownloadLimit.Wait(ctx, len(b.BlockData)); err != nil {
+					return err
+				}
+			}
+			return verifyContent(remote, downloaded, sum.Sum(nil))
+		})
 		if err != nil {
-			log.Println(err)
+			return downloaded, err
 		}
-		meta.Version = mostRecentVer
+	}
+	if remote.Mode != 0 {
+		if err := os.Chmod(filePath, fs.FileMode(remote.Mode).Perm()); err != nil {
+			return downloaded, err
+		}
+	}
+	if remote.ModTime != 0 {
+		modTime := time.Unix(0, remote.ModTime)
+		if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+			return downloaded, err
+		}
+	}
+
+	proto.Reset(local)
+	proto.Merge(local, remote)
+	return downloaded, nil
+}
+
+// removeEmptyParents removes the directories above a deleted file that it
+// left empty, up to but not including the base directory
+func removeEmptyParents(baseDir string, filePath string) {
+	base := filepath.Clean(baseDir)
+	for dir := filepath.Dir(filePath); dir != base && strings.HasPrefix(dir, base); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// localPath returns where a file from the server belongs in the base
+// directory. It refuses names that would leave the base directory, and
+// paths through a symlinked directory, which could point anywhere.
+func localPath(baseDir string, fileName string) (string, error) {
+	if err := ValidFileName(fileName); err != nil {
+		return "", err
+	}
+	dir := baseDir
+	parts := strings.Split(fileName, "/")
+	for _, part := range parts[:len(parts)-1] {
+		dir = ConcatPath(dir, part)
+		info, err := os.Lstat(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("not writing %s through the symlink %s", fileName, dir)
+		}
+	}
+	return ConcatPath(baseDir, fileName), nil
+}
+
+// renameRemote commits the rename of a local file on the server, from the
+// version of the old name the server had when the sync was planned. On success
+// the index entries of both names take the server's metadata, on failure
+// they keep their local versions and the next sync uploads the new name
+// and deletes the old one instead.
+func renameRemote(ctx context.Context, client RPCClient, from *FileMetaData, fromVersion int32, to *FileMetaData) error {
+	log.Printf("[Client %s] rename %s to %s\n", client.BaseDir, from.Filename, to.Filename)
+
+	var renamed map[string]*FileMetaData
+	if err := client.RenameFile(ctx, from.Filename, fromVersion, wireMetaData(to), &renamed); err != nil {
 		return err
 	}
+	for _, meta := range []*FileMetaData{from, to} {
+		if serverMeta, ok := renamed[meta.Filename]; ok {
+			hashes := meta.BlockHashList
+			proto.Reset(meta)
+			proto.Merge(meta, serverMeta)
+			keepBlockList(meta, hashes)
+		}
+	}
+	return nil
+}
+
+// renameLocal moves the local copy of a file the server renamed, then
+// restores the metadata of the remote file, and returns the new index entry
+func renameLocal(ctx context.Context, client RPCClient, oldLocal *FileMetaData, remote *FileMetaData, address string) (*FileMetaData, error) {
+	oldPath, err := localPath(client.BaseDir, oldLocal.Filename)
+	if err != nil {
+		return nil, err
+	}
+	newPath, err := localPath(client.BaseDir, remote.Filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return nil, err
+	}
+
+	local := proto.Clone(oldLocal).(*FileMetaData)
+	local.Filename = remote.Filename
+	if _, err := download(ctx, client, local, remote, address, nil); err != nil {
+		return nil, err
+	}
+	return local, nil
+}
+
+// upload puts every block of the file, unless putBlocks is false because
+// the server already has them. When an interrupted upload is resumed, the
+// blocks that already landed are skipped. It returns once the BlockStore
+// confirms it has every block, so the metadata can be committed with
+// commitUploads. The block list of a file with more than the client's
+// BlockTreeThreshold blocks is stored as a tree. It returns the number of
+// bytes uploaded.
+func upload(ctx context.Context, client RPCClient, meta *FileMetaData, address string, putBlocks bool, resume bool, progress *progressTracker) (int64, error) {
+	log.Printf("[Client %s] start func upload %s\n", client.BaseDir, meta.Filename)
+
+	filePath := ConcatPath(client.BaseDir, meta.Filename)
+	if isTombstone(meta) || meta.SymlinkTarget != "" || !putBlocks {
+		return 0, nil
+	}
+
+	stored := make(map[string]bool)
+	if resume {
+		var err error
+		if stored, err = hasBlocks(ctx, client, meta.BlockHashList, address); err != nil {
+			return 0, err
+		}
+	}
 
 	file, err := os.Open(filePath)
 	if err != nil {
-		log.Println(err)
+		return 0, err
 	}
 	defer file.Close()
 
-	fileStat, _ := os.Stat(filePath)
-	var n int = int(math.Ceil(float64(fileStat.Size()) / float64(client.BlockSize)))
-	for j := 0; j < n; j++ {
-		slice := make([]byte, client.BlockSize)
-		len, err := file.Read(slice)
-		if err != nil && err != io.EOF {
-			log.Println(err)
+	var uploaded int64
+	slice := make([]byte, fileBlockSize(meta, client.BlockSize))
+	for {
+		len, err := io.ReadFull(file, slice)
+		if len > 0 && !stored[GetBlockHashString(slice[:len])] {
+			block := Block{BlockData: slice[:len], BlockSize: int32(len)}
+
+			if err := client.UploadLimit.Wait(ctx, len); err != nil {
+				return uploaded, err
+			}
+			var succ bool
+			if err := client.PutBlock(ctx, &block, NamespaceOf(meta.Filename), address, &succ); err != nil {
+				return uploaded, err
+			}
+			uploaded += int64(len)
+			progress.block(len)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
 		}
-		slice = slice[:len]
+		if err != nil {
+			return uploaded, err
+		}
+	}
+
+	if err := confirmBlocks(ctx, client, meta, address); err != nil {
+		return uploaded, err
+	}
+	meta.BlockTreeRoot = ""
+	if client.BlockTreeThreshold > 0 && len(meta.BlockHashList) > client.BlockTreeThreshold {
+		root, err := putBlockTree(ctx, client, meta, address)
+		if err != nil {
+			return uploaded, err
+		}
+		meta.BlockTreeRoot = root
+	}
+	return uploaded, nil
+}
 
-		block := Block{BlockData: slice, BlockSize: int32(len)}
+// stagedUpload is a file whose blocks are uploaded and whose metadata
+// waits to be committed
+type stagedUpload struct {
+	planned plannedAction
+	start   time.Time
+	bytes   int64
+}
 
-		var succ bool
-		if err := client.PutBlock(&block, address, &succ); err != nil {
-			log.Println(err)
+// commitUploads commits the metadata of the staged files and returns the
+// error of each. Files are committed in atomic UpdateFiles batches of up to
+// updateBatchMaxBytes of metadata. When the MetaStore rejects a batch
+// because of one file, e.g. because it conflicts, its files are committed
+// one by one so the others still go through. A batch that fails for any
+// other reason, such as a quota or an unreachable server, fails as a
+// whole. On failure the local version is kept, so the change is retried
+// next sync.
+func commitUploads(ctx context.Context, client RPCClient, staged []stagedUpload) []error {
+	errs := make([]error, len(staged))
+	wire := make([]*FileMetaData, len(staged))
+	for i, entry := range staged {
+		wire[i] = wireMetaData(entry.planned.local)
+	}
+	for first := 0; first < len(staged); {
+		last, size := first+1, proto.Size(wire[first])
+		for last < len(staged) && size+proto.Size(wire[last]) <= updateBatchMaxBytes {
+			size += proto.Size(wire[last])
+			last++
 		}
+		commitBatch(ctx, client, staged[first:last], wire[first:last], errs[first:last])
+		first = last
 	}
+	return errs
+}
 
-	if err := client.UpdateFile(meta, &mostRecentVer); err != nil {
-		log.Println(err)
-		meta.Version = -1
+func commitBatch(ctx context.Context, client RPCClient, staged []stagedUpload, batch []*FileMetaData, errs []error) {
+	if len(staged) > 1 {
+		var committed map[string]*FileMetaData
+		err := client.UpdateFiles(ctx, batch, &committed)
+		if err == nil {
+			for i, entry := range staged {
+				meta, ok := committed[entry.planned.local.Filename]
+				if !ok {
+					errs[i] = fmt.Errorf("MetaStore did not return the committed metadata of %s", entry.planned.local.Filename)
+					continue
+				}
+				entry.planned.local.Version = meta.Version
+			}
+			return
+		}
+		// only a rejection of one of the files is worth retrying without it;
+		// anything else would fail the same way, or commit half the batch
+		switch status.Code(err) {
+		case codes.FailedPrecondition, codes.PermissionDenied, codes.InvalidArgument:
+			log.Printf("[Client %s] batch of %d files rejected, committing them one by one: %v\n", client.BaseDir, len(batch), err)
+		default:
+			for i := range errs {
+				errs[i] = err
+			}
+			return
+		}
 	}
-	meta.Version = mostRecentVer
 
+	for i, entry := range staged {
+		var mostRecentVer int32
+		if err := client.UpdateFile(ctx, batch[i], &mostRecentVer); err != nil {
+			errs[i] = err
+			continue
+		}
+		entry.planned.local.Version = mostRecentVer
+	}
+}
+
+// confirmBlocks checks that the BlockStore has every block of the file
+func confirmBlocks(ctx context.Context, client RPCClient, meta *FileMetaData, address string) error {
+	stored, err := hasBlocks(ctx, client, meta.BlockHashList, address)
+	if err != nil {
+		return err
+	}
+	missing := 0
+	for _, hash := range meta.BlockHashList {
+		if !stored[hash] {
+			missing++
+		}
+	}
+	if missing > 0 {
+		return fmt.Errorf("%d of %d blocks of %s did not reach the BlockStore", missing, len(meta.BlockHashList), meta.Filename)
+	}
 	return nil
 }
+
+// hasBlocks returns which of the hashes the BlockStore has, asking about
+// HAS_BLOCKS_BATCH_SIZE of them at a time
+func hasBlocks(ctx context.Context, client RPCClient, hashes []string, address string) (map[string]bool, error) {
+	stored := make(map[string]bool)
+	for first := 0; first < len(hashes); first += HAS_BLOCKS_BATCH_SIZE {
+		last := first + HAS_BLOCKS_BATCH_SIZE
+		if last > len(hashes) {
+			last = len(hashes)
+		}
+		var present []string
+		if err := client.HasBlocks(ctx, hashes[first:last], address, &present); err != nil {
+			return nil, err
+		}
+		for _, hash := range present {
+			stored[hash] = true
+		}
+	}
+	return stored, nil
+}
+
+// wireMetaData is the metadata of a file as it is sent to the MetaStore,
+// without the block list if it is stored as a tree
+func wireMetaData(meta *FileMetaData) *FileMetaData {
+	if meta.BlockTreeRoot == "" || len(meta.BlockHashList) == 0 {
+		return meta
+	}
+	wire := proto.Clone(meta).(*FileMetaData)
+	wire.BlockHashList = nil
+	return wire
+}
+
+// keepBlockList restores the local block list of an entry that took the
+// server's metadata, which only has the tree, if the content is the same
+func keepBlockList(meta *FileMetaData, hashes []string) {
+	if len(meta.BlockHashList) == 0 && meta.BlockTreeRoot != "" && len(hashes) > 0 &&
+		meta.BlockTreeRoot == blockTreeRoot(&FileMetaData{BlockHashList: hashes}) {
+		meta.BlockHashList = hashes
+	}
+}
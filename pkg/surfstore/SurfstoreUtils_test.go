@@ -0,0 +1,826 @@
+package surfstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// startTestServer serves a MetaStore and a BlockStore on a local port
+func startTestServer(t *testing.T, opts ...grpc.ServerOption) (string, *MetaStore, *BlockStore) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(opts...)
+	addr := listener.Addr().String()
+	metaStore := NewMetaStore(addr)
+	blockStore := NewBlockStore()
+	blockStore.Permissions = metaStore
+	RegisterMetaStoreServer(server, metaStore)
+	RegisterBlockStoreServer(server, blockStore)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return addr, metaStore, blockStore
+}
+
+func TestClientSyncReportsCommitConflict(t *testing.T) {
+	ctx := context.Background()
+	// once armed, another client deletes the file just before this one commits
+	var metaStore *MetaStore
+	armed := make(chan struct{}, 1)
+	addr, server, _ := startTestServer(t, grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if info.FullMethod != "/surfstore.MetaStore/UpdateFile" {
+			return handler(ctx, req)
+		}
+		select {
+		case <-armed:
+			if _, err := metaStore.UpdateFile(ctx, &FileMetaData{Filename: "f", Version: 2, Deleted: true}); err != nil {
+				t.Errorf("competing delete: %v", err)
+			}
+		default:
+		}
+		return handler(ctx, req)
+	}))
+	metaStore = server
+
+	dir := t.TempDir()
+	client := NewSurfstoreRPCClient(addr, dir, 4096)
+	if err := os.WriteFile(filepath.Join(dir, "f"), []byte("one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ClientSync(ctx, client, SyncOptions{}); err != nil {
+		t.Fatalf("first sync: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "f"), []byte("two"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	armed <- struct{}{}
+	report, err := ClientSync(ctx, client, SyncOptions{FullRescan: true})
+	if err == nil {
+		t.Fatal("sync with a conflicting commit succeeded")
+	}
+	if len(report.Files) != 1 {
+		t.Fatalf("report has %d rows, want 1: %+v", len(report.Files), report.Files)
+	}
+	if row := report.Files[0]; row.Filename != "f" || row.Action != ACTION_CONFLICT || row.Err == nil {
+		t.Errorf("report row %+v, want a failed conflict on f", row)
+	}
+}
+
+func TestClientSyncReportsConflictBehindSeveralVersions(t *testing.T) {
+	ctx := context.Background()
+	addr, _, _ := startTestServer(t)
+	dirA, dirB := t.TempDir(), t.TempDir()
+	clientA := NewSurfstoreRPCClient(addr, dirA, 4096)
+	clientB := NewSurfstoreRPCClient(addr, dirB, 4096)
+
+	if err := os.WriteFile(filepath.Join(dirA, "f"), []byte("one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ClientSync(ctx, clientA, SyncOptions{}); err != nil {
+		t.Fatalf("first sync of A: %v", err)
+	}
+	if _, err := ClientSync(ctx, clientB, SyncOptions{}); err != nil {
+		t.Fatalf("first sync of B: %v", err)
+	}
+
+	// B commits versions 2 and 3 while A edits version 1
+	for _, content := range []string{"two", "three"} {
+		if err := os.WriteFile(filepath.Join(dirB, "f"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ClientSync(ctx, clientB, SyncOptions{FullRescan: true}); err != nil {
+			t.Fatalf("sync of B with %q: %v", content, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dirA, "f"), []byte("edit"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := ClientSync(ctx, clientA, SyncOptions{FullRescan: true})
+	if err != nil {
+		t.Fatalf("sync of A: %v", err)
+	}
+	if len(report.Files) != 1 || report.Files[0].Filename != "f" || report.Files[0].Action != ACTION_CONFLICT {
+		t.Errorf("report rows %+v, want a conflict on f", report.Files)
+	}
+	if content, err := os.ReadFile(filepath.Join(dirA, "f")); err != nil || string(content) != "three" {
+		t.Errorf("f holds %q, %v, want the server's version 3", content, err)
+	}
+}
+
+func TestClientSyncDownloadsUnchangedFileBehindSeveralVersions(t *testing.T) {
+	ctx := context.Background()
+	addr, _, _ := startTestServer(t)
+	dirA, dirB := t.TempDir(), t.TempDir()
+	clientA := NewSurfstoreRPCClient(addr, dirA, 4096)
+	clientB := NewSurfstoreRPCClient(addr, dirB, 4096)
+
+	if err := os.WriteFile(filepath.Join(dirA, "f"), []byte("one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the second sync of A moves it onto the change feed
+	for _, client := range []RPCClient{clientA, clientB, clientA} {
+		if _, err := ClientSync(ctx, client, SyncOptions{}); err != nil {
+			t.Fatalf("sync of %s: %v", client.BaseDir, err)
+		}
+	}
+	for _, content := range []string{"two", "three"} {
+		if err := os.WriteFile(filepath.Join(dirB, "f"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ClientSync(ctx, clientB, SyncOptions{FullRescan: true}); err != nil {
+			t.Fatalf("sync of B with %q: %v", content, err)
+		}
+	}
+
+	// A did not touch f, so it is a plain download
+	report, err := ClientSync(ctx, clientA, SyncOptions{FullRescan: true})
+	if err != nil {
+		t.Fatalf("sync of A: %v", err)
+	}
+	if len(report.Files) != 1 || report.Files[0].Filename != "f" || report.Files[0].Action != ACTION_DOWNLOAD {
+		t.Errorf("report rows %+v, want a download of f", report.Files)
+	}
+}
+
+func TestClientSyncKeepsPositionAfterSkips(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read a file without permissions")
+	}
+	ctx := context.Background()
+	addr, metaStore, _ := startTestServer(t)
+	dir := t.TempDir()
+	client := NewSurfstoreRPCClient(addr, dir, 4096)
+	for _, fileName := range []string{"readable", "unreadable"} {
+		if err := os.WriteFile(filepath.Join(dir, fileName), []byte(fileName), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ClientSync(ctx, client, SyncOptions{}); err != nil {
+		t.Fatalf("first sync: %v", err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "unreadable"), 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(filepath.Join(dir, "unreadable"), 0644) })
+
+	tests := []struct {
+		name         string
+		remoteChange bool
+		wantPosition bool
+	}{
+		{"no change on the server", false, true},
+		{"the skipped file changed on the server", true, false},
+	}
+	for _, tt := range tests {
+		if tt.remoteChange {
+			version := metaStore.FileMetaMap["unreadable"].Version
+			if _, err := metaStore.UpdateFile(ctx, &FileMetaData{Filename: "unreadable", Version: version + 1, Deleted: true}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		report, err := ClientSync(ctx, client, SyncOptions{FullRescan: true})
+		if err != nil {
+			t.Fatalf("%s: sync with an unreadable file: %v", tt.name, err)
+		}
+		if len(report.Failed()) != 0 || len(report.Skipped()) != 1 {
+			t.Errorf("%s: %d failed and %d skipped, want only the unreadable file skipped", tt.name, len(report.Failed()), len(report.Skipped()))
+		}
+		index, err := LoadLocalIndex(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := index.Epoch != ""; got != tt.wantPosition {
+			t.Errorf("%s: index keeps the change feed position %v, want %v", tt.name, got, tt.wantPosition)
+		}
+	}
+}
+
+func TestClientSyncDownloadsUnignoredFile(t *testing.T) {
+	ctx := context.Background()
+	addr, _, _ := startTestServer(t)
+	dirA, dirB := t.TempDir(), t.TempDir()
+	clientA := NewSurfstoreRPCClient(addr, dirA, 4096)
+	clientB := NewSurfstoreRPCClient(addr, dirB, 4096)
+
+	if err := os.WriteFile(filepath.Join(dirA, "f.swp"), []byte("swap"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ClientSync(ctx, clientA, SyncOptions{}); err != nil {
+		t.Fatalf("sync of A: %v", err)
+	}
+	// the second sync moves B onto the change feed past f.swp
+	for i := 0; i < 2; i++ {
+		if _, err := ClientSync(ctx, clientB, SyncOptions{Excludes: []string{"*.swp"}}); err != nil {
+			t.Fatalf("sync of B excluding *.swp: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dirB, "f.swp")); !os.IsNotExist(err) {
+		t.Fatalf("the excluded f.swp was synced: %v", err)
+	}
+
+	if _, err := ClientSync(ctx, clientB, SyncOptions{}); err != nil {
+		t.Fatalf("sync of B without the exclude: %v", err)
+	}
+	if content, err := os.ReadFile(filepath.Join(dirB, "f.swp")); err != nil || string(content) != "swap" {
+		t.Errorf("f.swp holds %q, %v, want it downloaded once it is no longer excluded", content, err)
+	}
+}
+
+func TestClientSyncFileReplacesDirectory(t *testing.T) {
+	ctx := context.Background()
+	addr, _, _ := startTestServer(t)
+	dirA, dirB := t.TempDir(), t.TempDir()
+	clientA := NewSurfstoreRPCClient(addr, dirA, 4096)
+	clientB := NewSurfstoreRPCClient(addr, dirB, 4096)
+
+	if err := os.MkdirAll(filepath.Join(dirA, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dirA, "d", "x"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range []RPCClient{clientA, clientB} {
+		if _, err := ClientSync(ctx, client, SyncOptions{}); err != nil {
+			t.Fatalf("sync of %s: %v", client.BaseDir, err)
+		}
+	}
+
+	if err := os.RemoveAll(filepath.Join(dirA, "d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dirA, "d"), []byte("d"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ClientSync(ctx, clientA, SyncOptions{}); err != nil {
+		t.Fatalf("sync of A after replacing d: %v", err)
+	}
+	if _, err := ClientSync(ctx, clientB, SyncOptions{}); err != nil {
+		t.Fatalf("sync of B after d became a file: %v", err)
+	}
+	if content, err := os.ReadFile(filepath.Join(dirB, "d")); err != nil || string(content) != "d" {
+		t.Errorf("d holds %q, %v, want the file that replaced the directory", content, err)
+	}
+}
+
+func TestClientSyncFailedDownloadKeepsLocalFile(t *testing.T) {
+	ctx := context.Background()
+	addr, _, bs := startTestServer(t)
+	dirA, dirB := t.TempDir(), t.TempDir()
+	clientA := NewSurfstoreRPCClient(addr, dirA, 4096)
+	clientB := NewSurfstoreRPCClient(addr, dirB, 4096)
+
+	if err := os.WriteFile(filepath.Join(dirA, "f"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range []RPCClient{clientA, clientB} {
+		if _, err := ClientSync(ctx, client, SyncOptions{}); err != nil {
+			t.Fatalf("sync of %s: %v", client.BaseDir, err)
+		}
+	}
+
+	// the last block of the new version goes missing
+	content := bytes.Repeat([]byte("n"), 3*4096-1)
+	content = append(content, 'e')
+	if err := os.WriteFile(filepath.Join(dirA, "f"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ClientSync(ctx, clientA, SyncOptions{}); err != nil {
+		t.Fatalf("sync of the new version: %v", err)
+	}
+	delete(bs.BlockMap, GetBlockHashString(content[2*4096:]))
+	// and an interrupted download of B was left behind
+	if err := os.WriteFile(filepath.Join(dirB, PARTIAL_DOWNLOAD_PREFIX+"f"), []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var partial *PartialSyncError
+	if _, err := ClientSync(ctx, clientB, SyncOptions{}); !errors.As(err, &partial) {
+		t.Fatalf("sync with a missing block = %v, want a PartialSyncError", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dirB, "f")); err != nil || string(got) != "old" {
+		t.Errorf("f holds %q, %v, want the old version kept", got, err)
+	}
+	entries, err := os.ReadDir(dirB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if IsPartialDownload(entry.Name()) {
+			t.Errorf("the partial download %s was left behind", entry.Name())
+		}
+	}
+}
+
+func TestClientSyncResumesJournaledUpload(t *testing.T) {
+	tests := []struct {
+		name     string
+		edit     func(entry *journalEntry)
+		wantPuts int
+	}{
+		{"same upload", func(entry *journalEntry) {}, 1},
+		{"other version", func(entry *journalEntry) { entry.Version++ }, 3},
+		{"other content", func(entry *journalEntry) { entry.BlockHashList[0] = GetBlockHashString([]byte("other")) }, 3},
+	}
+	for _, tt := range tests {
+		ctx := context.Background()
+		// the third PutBlock fails once
+		puts, failAt := 0, 3
+		addr, _, _ := startTestServer(t, grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if info.FullMethod == "/surfstore.BlockStore/PutBlock" {
+				puts++
+				if puts == failAt {
+					return nil, status.Error(codes.Internal, "interrupted")
+				}
+			}
+			return handler(ctx, req)
+		}))
+		dir := t.TempDir()
+		client := NewSurfstoreRPCClient(addr, dir, 4096)
+		content := append(bytes.Repeat([]byte("a"), 4096), bytes.Repeat([]byte("b"), 4096)...)
+		content = append(content, 'c')
+		if err := os.WriteFile(filepath.Join(dir, "f"), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ClientSync(ctx, client, SyncOptions{}); err == nil {
+			t.Fatalf("%s: interrupted sync succeeded", tt.name)
+		}
+
+		journal, err := loadUploadJournal(dir)
+		if err != nil || journal.Uploads["f"] == nil {
+			t.Fatalf("%s: journal %v, %v, want the upload of f", tt.name, journal, err)
+		}
+		tt.edit(journal.Uploads["f"])
+		if err := journal.write(dir); err != nil {
+			t.Fatal(err)
+		}
+
+		puts, failAt = 0, -1
+		if _, err := ClientSync(ctx, client, SyncOptions{}); err != nil {
+			t.Fatalf("%s: resumed sync: %v", tt.name, err)
+		}
+		if puts != tt.wantPuts {
+			t.Errorf("%s: resumed sync put %d blocks, want %d", tt.name, puts, tt.wantPuts)
+		}
+	}
+}
+
+func TestRunDaemonBacksOff(t *testing.T) {
+	// every sync fails at its first call, and so does the watch stream
+	attempts := make(chan time.Time, 10)
+	addr, _, _ := startTestServer(t, grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if info.FullMethod == "/surfstore.MetaStore/GetBlockSizeRange" {
+			select {
+			case attempts <- time.Now():
+			default:
+			}
+			return nil, status.Error(codes.Internal, "down")
+		}
+		return handler(ctx, req)
+	}), grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return status.Error(codes.Internal, "down")
+	}))
+	client := NewSurfstoreRPCClient(addr, t.TempDir(), 4096)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := DefaultDaemonOptions()
+	opts.MinBackoff, opts.MaxBackoff = 10*time.Millisecond, 80*time.Millisecond
+	done := make(chan error)
+	go func() { done <- RunDaemon(ctx, client, opts) }()
+
+	var times []time.Time
+	for len(times) < 6 {
+		select {
+		case at := <-attempts:
+			times = append(times, at)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the daemon made %d attempts, want 6", len(times))
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("RunDaemon = %v", err)
+	}
+
+	want := []time.Duration{10, 20, 40, 80, 80}
+	for i, backoff := range want {
+		backoff *= time.Millisecond
+		if gap := times[i+1].Sub(times[i]); gap < backoff || gap > backoff+time.Second {
+			t.Errorf("retry %d came after %v, want a backoff of %v", i+1, gap, backoff)
+		}
+	}
+}
+
+func TestClientSyncDryRunChangesNothing(t *testing.T) {
+	ctx := context.Background()
+	addr, m, _ := startTestServer(t)
+	dirA, dirB := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(dirA, "down"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ClientSync(ctx, NewSurfstoreRPCClient(addr, dirA, 4096), SyncOptions{}); err != nil {
+		t.Fatalf("sync of A: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dirB, "up"), []byte("hi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := ClientSync(ctx, NewSurfstoreRPCClient(addr, dirB, 4096), SyncOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	var planned []FileOutcome
+	for _, outcome := range report.Files {
+		planned = append(planned, FileOutcome{Filename: outcome.Filename, Action: outcome.Action, Bytes: outcome.Bytes})
+	}
+	want := []FileOutcome{{Filename: "up", Action: ACTION_UPLOAD, Bytes: 2}, {Filename: "down", Action: ACTION_DOWNLOAD, Bytes: 5}}
+	if !report.DryRun || !reflect.DeepEqual(planned, want) {
+		t.Errorf("dry run planned %+v, want %+v", planned, want)
+	}
+
+	entries, err := os.ReadDir(dirB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "up" {
+		t.Errorf("after the dry run B holds %v, want only up", entries)
+	}
+	if _, ok := m.FileMetaMap["up"]; ok {
+		t.Error("the dry run uploaded up")
+	}
+}
+
+func TestClientSyncSelectionReset(t *testing.T) {
+	ctx := context.Background()
+	addr, _, _ := startTestServer(t)
+	dirA, dirB := t.TempDir(), t.TempDir()
+	for _, fileName := range []string{"docs/a", "photos/b"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dirA, fileName)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dirA, fileName), []byte(fileName), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ClientSync(ctx, NewSurfstoreRPCClient(addr, dirA, 4096), SyncOptions{}); err != nil {
+		t.Fatalf("sync of A: %v", err)
+	}
+
+	clientB := NewSurfstoreRPCClient(addr, dirB, 4096)
+	tests := []struct {
+		name      string
+		selection []string
+		want      map[string]bool
+	}{
+		{"select docs", []string{"docs"}, map[string]bool{"docs/a": true, "photos/b": false}},
+		{"saved selection", nil, map[string]bool{"docs/a": true, "photos/b": false}},
+		{"select everything", []string{}, map[string]bool{"docs/a": true, "photos/b": true}},
+	}
+	for _, tt := range tests {
+		if _, err := ClientSync(ctx, clientB, SyncOptions{Selection: tt.selection}); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for fileName, want := range tt.want {
+			if _, err := os.Stat(filepath.Join(dirB, fileName)); (err == nil) != want {
+				t.Errorf("%s: %s synced = %v, want %v", tt.name, fileName, err == nil, want)
+			}
+		}
+	}
+}
+
+func TestClientSyncModeOnlyChange(t *testing.T) {
+	ctx := context.Background()
+	puts := 0
+	addr, _, _ := startTestServer(t, grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if info.FullMethod == "/surfstore.BlockStore/PutBlock" {
+			puts++
+		}
+		return handler(ctx, req)
+	}))
+	dirA, dirB := t.TempDir(), t.TempDir()
+	clientA := NewSurfstoreRPCClient(addr, dirA, 4096)
+	clientB := NewSurfstoreRPCClient(addr, dirB, 4096)
+
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.WriteFile(filepath.Join(dirA, "f"), []byte("script"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(dirA, "f"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("f", filepath.Join(dirA, "l")); err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range []RPCClient{clientA, clientB} {
+		if _, err := ClientSync(ctx, client, SyncOptions{}); err != nil {
+			t.Fatalf("sync of %s: %v", client.BaseDir, err)
+		}
+	}
+
+	if err := os.Chmod(filepath.Join(dirA, "f"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	puts = 0
+	report, err := ClientSync(ctx, clientA, SyncOptions{})
+	if err != nil {
+		t.Fatalf("sync of the chmod: %v", err)
+	}
+	if len(report.Files) != 1 || report.Files[0].Action != ACTION_UPLOAD || report.Files[0].Bytes != 0 || puts != 0 {
+		t.Errorf("the chmod synced as %+v with %d blocks put, want a metadata-only upload", report.Files, puts)
+	}
+	if _, err := ClientSync(ctx, clientB, SyncOptions{}); err != nil {
+		t.Fatalf("sync of B: %v", err)
+	}
+
+	info, err := os.Stat(filepath.Join(dirB, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 || !info.ModTime().Equal(modTime) {
+		t.Errorf("f has mode %v and mtime %v, want %v and %v", info.Mode().Perm(), info.ModTime(), fs.FileMode(0755), modTime)
+	}
+	if target, err := os.Readlink(filepath.Join(dirB, "l")); err != nil || target != "f" {
+		t.Errorf("l links to %q, %v, want f", target, err)
+	}
+}
+
+func TestClientSyncStatCache(t *testing.T) {
+	ctx := context.Background()
+	addr, m, _ := startTestServer(t)
+	dir := t.TempDir()
+	client := NewSurfstoreRPCClient(addr, dir, 4096)
+	filePath := filepath.Join(dir, "f")
+	modTime := time.Now().Add(-time.Hour)
+	write := func(content string) {
+		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("one")
+	if _, err := ClientSync(ctx, client, SyncOptions{}); err != nil {
+		t.Fatalf("first sync: %v", err)
+	}
+
+	// an edit that keeps the size and modification time is not noticed...
+	write("two")
+	report, err := ClientSync(ctx, client, SyncOptions{})
+	if err != nil || len(report.Files) != 0 || m.FileMetaMap["f"].Version != 1 {
+		t.Errorf("sync trusting the stat cache = %+v, %v, want nothing synced", report, err)
+	}
+
+	// ...unless every file is hashed again
+	report, err = ClientSync(ctx, client, SyncOptions{FullRescan: true})
+	if err != nil || len(report.Files) != 1 || report.Files[0].Action != ACTION_UPLOAD || m.FileMetaMap["f"].Version != 2 {
+		t.Errorf("full rescan = %+v, %v, want f uploaded", report, err)
+	}
+}
+
+func TestClientSyncRename(t *testing.T) {
+	ctx := context.Background()
+	transfers := 0
+	addr, m, _ := startTestServer(t, grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if info.FullMethod == "/surfstore.BlockStore/PutBlock" || info.FullMethod == "/surfstore.BlockStore/GetBlock" {
+			transfers++
+		}
+		return handler(ctx, req)
+	}))
+	dirA, dirB := t.TempDir(), t.TempDir()
+	clientA := NewSurfstoreRPCClient(addr, dirA, 4096)
+	clientB := NewSurfstoreRPCClient(addr, dirB, 4096)
+
+	if err := os.WriteFile(filepath.Join(dirA, "a"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range []RPCClient{clientA, clientB} {
+		if _, err := ClientSync(ctx, client, SyncOptions{}); err != nil {
+			t.Fatalf("sync of %s: %v", client.BaseDir, err)
+		}
+	}
+
+	if err := os.Mkdir(filepath.Join(dirA, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dirA, "a"), filepath.Join(dirA, "dir", "b")); err != nil {
+		t.Fatal(err)
+	}
+	transfers = 0
+	for _, client := range []RPCClient{clientA, clientB} {
+		report, err := ClientSync(ctx, client, SyncOptions{})
+		if err != nil {
+			t.Fatalf("sync of %s after the rename: %v", client.BaseDir, err)
+		}
+		want := []FileOutcome{{Filename: "dir/b", RenamedFrom: "a", Action: ACTION_RENAME}}
+		if len(report.Files) != 1 || report.Files[0].Filename != "dir/b" || report.Files[0].RenamedFrom != "a" || report.Files[0].Action != ACTION_RENAME {
+			t.Errorf("sync of %s = %+v, want %+v", client.BaseDir, report.Files, want)
+		}
+	}
+	if transfers != 0 {
+		t.Errorf("the rename transferred %d blocks, want none", transfers)
+	}
+
+	if !m.FileMetaMap["a"].Deleted || m.FileMetaMap["dir/b"].Deleted {
+		t.Errorf("server has a = %v and dir/b = %v, want a deleted and dir/b live", m.FileMetaMap["a"], m.FileMetaMap["dir/b"])
+	}
+	if _, err := os.Stat(filepath.Join(dirB, "a")); !os.IsNotExist(err) {
+		t.Errorf("B still has a: %v", err)
+	}
+	if content, err := os.ReadFile(filepath.Join(dirB, "dir", "b")); err != nil || string(content) != "content" {
+		t.Errorf("B has dir/b = %q, %v, want the renamed file", content, err)
+	}
+}
+
+func TestClientSyncReportsProgress(t *testing.T) {
+	ctx := context.Background()
+	addr, _, _ := startTestServer(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "big"), bytes.Repeat([]byte("b"), 10000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "small"), []byte("small"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var reports []Progress
+	opts := SyncOptions{Progress: ProgressFunc(func(p Progress) { reports = append(reports, p) })}
+	if _, err := ClientSync(ctx, NewSurfstoreRPCClient(addr, dir, 4096), opts); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if len(reports) == 0 {
+		t.Fatal("no progress was reported")
+	}
+
+	midway := false
+	for i, p := range reports {
+		if p.FilesTotal != 2 || p.BytesTotal != 10005 {
+			t.Errorf("report %d: %d files of %d bytes in total, want 2 of 10005", i, p.FilesTotal, p.BytesTotal)
+		}
+		if i > 0 && (p.BytesDone < reports[i-1].BytesDone || p.FilesDone < reports[i-1].FilesDone) {
+			t.Errorf("report %d went back from %+v to %+v", i, reports[i-1], p)
+		}
+		if p.Current == "big" && p.BytesDone > 0 && p.BytesDone < 10000 {
+			midway = true
+		}
+	}
+	if !midway {
+		t.Error("no report came between the blocks of big")
+	}
+	if first := reports[0]; first.FilesDone != 0 || first.BytesDone != 0 {
+		t.Errorf("first report %+v, want nothing done", first)
+	}
+	if last := reports[len(reports)-1]; last.FilesDone != 2 || last.BytesDone != 10005 || last.Current != "" {
+		t.Errorf("last report %+v, want everything done", last)
+	}
+}
+
+func TestClientSyncBlockSizes(t *testing.T) {
+	ctx := context.Background()
+	addr, m, _ := startTestServer(t)
+	m.DefaultBlockSize, m.MinBlockSize, m.MaxBlockSize = 1024, 512, 2048
+	dirA, dirB := t.TempDir(), t.TempDir()
+	// A takes the default, B asks for more than the MetaStore allows
+	clientA := NewSurfstoreRPCClient(addr, dirA, 0)
+	clientB := NewSurfstoreRPCClient(addr, dirB, 4096)
+
+	if err := os.WriteFile(filepath.Join(dirA, "f"), bytes.Repeat([]byte("f"), 3000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ClientSync(ctx, clientA, SyncOptions{}); err != nil {
+		t.Fatalf("sync of A: %v", err)
+	}
+	if _, err := ClientSync(ctx, clientB, SyncOptions{}); err != nil {
+		t.Fatalf("sync of B: %v", err)
+	}
+
+	// B edits f and adds g
+	if err := os.WriteFile(filepath.Join(dirB, "f"), bytes.Repeat([]byte("f"), 5000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dirB, "g"), bytes.Repeat([]byte("g"), 5000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ClientSync(ctx, clientB, SyncOptions{}); err != nil {
+		t.Fatalf("sync of B's edits: %v", err)
+	}
+
+	tests := []struct {
+		fileName  string
+		blockSize int32
+		blocks    int
+	}{
+		{"f", 1024, 5},
+		{"g", 2048, 3},
+	}
+	for _, tt := range tests {
+		meta := m.FileMetaMap[tt.fileName]
+		if meta.BlockSize != tt.blockSize || len(meta.BlockHashList) != tt.blocks {
+			t.Errorf("%s has %d blocks of %d bytes, want %d of %d", tt.fileName, len(meta.BlockHashList), meta.BlockSize, tt.blocks, tt.blockSize)
+		}
+	}
+}
+
+func TestClientSyncChecksContentHash(t *testing.T) {
+	ctx := context.Background()
+	addr, m, _ := startTestServer(t)
+	dirA, dirB := t.TempDir(), t.TempDir()
+	content := []byte("content")
+	if err := os.WriteFile(filepath.Join(dirA, "f"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ClientSync(ctx, NewSurfstoreRPCClient(addr, dirA, 4096), SyncOptions{}); err != nil {
+		t.Fatalf("sync of A: %v", err)
+	}
+	meta := m.FileMetaMap["f"]
+	if sum := sha256.Sum256(content); meta.Size != int64(len(content)) || meta.ContentHash != hex.EncodeToString(sum[:]) {
+		t.Fatalf("f was recorded with %d bytes and hash %q, want %d and its SHA-256", meta.Size, meta.ContentHash, len(content))
+	}
+
+	// the blocks no longer add up to the recorded content
+	sum := sha256.Sum256([]byte("other"))
+	meta.ContentHash = hex.EncodeToString(sum[:])
+	var partial *PartialSyncError
+	if _, err := ClientSync(ctx, NewSurfstoreRPCClient(addr, dirB, 4096), SyncOptions{}); !errors.As(err, &partial) || len(partial.Failed) != 1 {
+		t.Fatalf("sync of B = %v, want f to fail", err)
+	}
+	if _, err := os.Stat(filepath.Join(dirB, "f")); !os.IsNotExist(err) {
+		t.Errorf("the mismatched download of f was written: %v", err)
+	}
+}
+
+func TestClientSyncBlockTree(t *testing.T) {
+	ctx := context.Background()
+	// data blocks are a single byte, so every longer block is an index block
+	indexPuts, indexGets := 0, 0
+	addr, m, _ := startTestServer(t, grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if block, ok := req.(*Block); ok && len(block.BlockData) > 1 {
+			indexPuts++
+		}
+		resp, err := handler(ctx, req)
+		if block, ok := resp.(*Block); ok && block != nil && len(block.BlockData) > 1 {
+			indexGets++
+		}
+		return resp, err
+	}))
+	dirA, dirB := t.TempDir(), t.TempDir()
+	clientA := NewSurfstoreRPCClient(addr, dirA, 1)
+	clientA.BlockTreeThreshold = 2
+	clientB := NewSurfstoreRPCClient(addr, dirB, 1)
+
+	// two level 0 index blocks under a root
+	content := make([]byte, BLOCK_TREE_FANOUT+100)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	if err := os.WriteFile(filepath.Join(dirA, "f"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range []RPCClient{clientA, clientB} {
+		if _, err := ClientSync(ctx, client, SyncOptions{}); err != nil {
+			t.Fatalf("sync of %s: %v", client.BaseDir, err)
+		}
+	}
+	if meta := m.FileMetaMap["f"]; meta.BlockTreeRoot == "" || len(meta.BlockHashList) != 0 {
+		t.Errorf("f was stored with root %q and %d hashes, want only a root", meta.BlockTreeRoot, len(meta.BlockHashList))
+	}
+	if got, err := os.ReadFile(filepath.Join(dirB, "f")); err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("B downloaded f with %d bytes, %v, want the %d bytes A uploaded", len(got), err, len(content))
+	}
+
+	// an edit in the second half only replaces its index block and the root
+	content[BLOCK_TREE_FANOUT+50] = 'x'
+	if err := os.WriteFile(filepath.Join(dirA, "f"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	indexPuts, indexGets = 0, 0
+	for _, client := range []RPCClient{clientA, clientB} {
+		if _, err := ClientSync(ctx, client, SyncOptions{}); err != nil {
+			t.Fatalf("sync of %s after the edit: %v", client.BaseDir, err)
+		}
+	}
+	if indexPuts != 2 || indexGets != 2 {
+		t.Errorf("the edit put %d index blocks and got %d, want 2 each", indexPuts, indexGets)
+	}
+	if got, err := os.ReadFile(filepath.Join(dirB, "f")); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("B has f with %d bytes, %v, want the edited file", len(got), err)
+	}
+}
@@ -0,0 +1,96 @@
+//go:build linux
+
+package surfstore
+
+import (
+	context "context"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask uint32 = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+	syscall.IN_ATTRIB | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// watchLocalChanges signals localEvents whenever a file under baseDir
+// changes, until ctx is done. Changes to the client's own metadata files
+// are ignored so that writing the index does not trigger another sync.
+func watchLocalChanges(ctx context.Context, baseDir string, localEvents chan<- struct{}) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	// a non-blocking fd wrapped in an os.File is read through the runtime
+	// poller, so closing it unblocks the reader
+	inotifyFile := os.NewFile(uintptr(fd), "inotify")
+
+	watchedDirs := make(map[int]string)
+	addWatches := func(root string) {
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return nil
+			}
+			wd, err := syscall.InotifyAddWatch(fd, path, inotifyMask)
+			if err != nil {
+				log.Printf("[Daemon %s] cannot watch %s: %v\n", baseDir, path, err)
+				return nil
+			}
+			watchedDirs[wd] = path
+			return nil
+		})
+	}
+	addWatches(baseDir)
+
+	go func() {
+		<-ctx.Done()
+		inotifyFile.Close()
+	}()
+
+	go func() {
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := inotifyFile.Read(buf)
+			if err != nil {
+				return
+			}
+
+			changed := false
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+				name := strings.TrimRight(string(nameBytes), "\x00")
+				offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+				if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+					changed = true
+					continue
+				}
+				dir, ok := watchedDirs[int(event.Wd)]
+				if !ok {
+					continue
+				}
+				if event.Mask&syscall.IN_IGNORED != 0 {
+					delete(watchedDirs, int(event.Wd))
+					continue
+				}
+				if (dir == baseDir && IsMetaFile(name)) || IsPartialDownload(name) {
+					continue
+				}
+				if event.Mask&syscall.IN_ISDIR != 0 && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+					addWatches(filepath.Join(dir, name))
+				}
+				changed = true
+			}
+
+			if changed {
+				signal(localEvents)
+			}
+		}
+	}()
+
+	return nil
+}
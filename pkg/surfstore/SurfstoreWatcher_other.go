@@ -0,0 +1,28 @@
+//go:build !linux
+
+package surfstore
+
+import (
+	context "context"
+	"time"
+)
+
+// Without inotify the base directory is polled
+const watchPollInterval = 10 * time.Second
+
+// watchLocalChanges signals localEvents every poll interval until ctx is done
+func watchLocalChanges(ctx context.Context, baseDir string, localEvents chan<- struct{}) error {
+	go func() {
+		ticker := time.NewTicker(watchPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				signal(localEvents)
+			}
+		}
+	}()
+	return nil
+}